@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"time"
+)
+
+// A K-line or D-line
+type ban struct {
+	// user@host mask for K-lines, IP or CIDR for D-lines
+	Mask   string    `json:"mask"`
+	Reason string    `json:"reason"`
+	SetBy  string    `json:"set_by"`
+	SetAt  time.Time `json:"set_at"`
+	// The zero time if the ban never expires
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+type banList struct {
+	Klines []ban `json:"klines"`
+	Dlines []ban `json:"dlines"`
+}
+
+func (b ban) hasExpired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
+
+// Returns an empty list if the file does not exist yet
+func loadBans(path string) (banList, error) {
+	bans := banList{[]ban{}, []ban{}}
+	if len(path) == 0 {
+		return bans, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return bans, nil
+	}
+	if err != nil {
+		return bans, err
+	}
+
+	err = json.Unmarshal(data, &bans)
+	return bans, err
+}
+
+// Writes to a temporary file first so a crash can't leave a partial list
+func saveBans(path string, bans banList) error {
+	if len(path) == 0 {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temp := path + ".tmp"
+	err = os.WriteFile(temp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// The reason, who set the ban and when it expires
+func (b ban) describe(now time.Time) string {
+	description := fmt.Sprintf("%v (set by %v)", b.Reason, b.SetBy)
+	if !b.Expires.IsZero() {
+		description += fmt.Sprintf(" (expires in %v)", b.Expires.Sub(now).Round(time.Second))
+	}
+
+	return description
+}
+
+// Removes expired bans, returning true if any were removed
+func (bans *banList) prune(now time.Time) bool {
+	before := len(bans.Klines) + len(bans.Dlines)
+	bans.Klines = slices.DeleteFunc(bans.Klines, func(b ban) bool { return b.hasExpired(now) })
+	bans.Dlines = slices.DeleteFunc(bans.Dlines, func(b ban) bool { return b.hasExpired(now) })
+
+	return before != len(bans.Klines)+len(bans.Dlines)
+}
+
+// Matches any of the user@hosts a user may be known by against the K-lines
+func (bans *banList) findKline(userHosts []string, casefold func(string) string) (ban, bool) {
+	for _, b := range bans.Klines {
+		if slices.ContainsFunc(userHosts, func(userHost string) bool { return matchMask(b.Mask, userHost, casefold) }) {
+			return b, true
+		}
+	}
+
+	return ban{}, false
+}
+
+func (bans *banList) findDline(ip string) (ban, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ban{}, false
+	}
+
+	for _, b := range bans.Dlines {
+		if matchIP(b.Mask, addr) {
+			return b, true
+		}
+	}
+
+	return ban{}, false
+}
+
+// mask is either a single address or a CIDR range
+func matchIP(mask string, addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	prefix, err := netip.ParsePrefix(mask)
+	if err == nil {
+		return prefix.Contains(addr)
+	}
+
+	maskAddr, err := netip.ParseAddr(mask)
+	return err == nil && maskAddr.Unmap() == addr
+}
+
+func isValidIPMask(mask string) bool {
+	_, err := netip.ParsePrefix(mask)
+	if err == nil {
+		return true
+	}
+	_, err = netip.ParseAddr(mask)
+	return err == nil
+}
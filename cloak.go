@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Shorter keys would make it easier to recover hosts by guessing
+const minCloakKeyLength = 16
+
+// Hides a client's host behind keyed hashes, while keeping enough structure for bans to still work.
+// K-lines on cloaks match too, see klineUserHosts.
+// Each part hashes a wider part of the address, so clients from the same network share a suffix:
+//
+//	192.0.2.1          -> 5B1C2E3F.9A8B7C6D.0F1E2D3C.IP (the address, /24 and /16)
+//	2001:db8::1        -> 5B1C2E3F:9A8B7C6D:0F1E2D3C:IP (the address, /64 and /48)
+//	client.example.com -> 5B1C2E3F.example.com
+func cloakHost(key string, host string) string {
+	var hash = func(s string) string {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(s))
+		return fmt.Sprintf("%X", mac.Sum(nil)[:4])
+	}
+
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%v.%v.%v.IP", hash(ip4.String()), hash(ip4.Mask(net.CIDRMask(24, 32)).String()),
+			hash(ip4.Mask(net.CIDRMask(16, 32)).String()))
+	}
+	if ip != nil {
+		return fmt.Sprintf("%v:%v:%v:IP", hash(ip.String()), hash(ip.Mask(net.CIDRMask(64, 128)).String()),
+			hash(ip.Mask(net.CIDRMask(48, 128)).String()))
+	}
+
+	labels := strings.Split(host, ".")
+	labels[0] = hash(host)
+	return strings.Join(labels, ".")
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Settings which can be changed by the server operator.
+// See ircd.example.yaml for the file format.
+type Config struct {
+	// The file the config was loaded from, used by REHASH
+	Path string `yaml:"-"`
+	Name string `yaml:"name"`
+	// Shown to clients in the NETWORK ISUPPORT token if set
+	Network   string           `yaml:"network"`
+	Listeners []ListenerConfig `yaml:"listeners"`
+	// Settings shared by the connections accepted by listeners in each class
+	Classes []ClassConfig `yaml:"classes"`
+	// File the message of the day is read from
+	MotdFile string `yaml:"motd_file"`
+	// Contact details shown by ADMIN
+	Admin AdminConfig `yaml:"admin"`
+	// Maximum number of targets a client can MONITOR
+	MonitorLimit int `yaml:"monitor_limit"`
+	// One of the keys of casemappings
+	Casemapping string `yaml:"casemapping"`
+	// Maximum length of a nickname
+	NickLength int `yaml:"nick_length"`
+	// Secret used to cloak the hosts of users, cloaking is off if empty. See cloakHost.
+	CloakKey string `yaml:"cloak_key"`
+	// Where K-lines and D-lines are saved, they are not persisted if empty
+	BanFile     string            `yaml:"ban_file"`
+	Opers       []OperConfig      `yaml:"opers"`
+	OperClasses []OperClassConfig `yaml:"oper_classes"`
+	// Web clients allowed to pass on the address of their users with WEBIRC
+	Webirc []WebircConfig `yaml:"webirc"`
+	// Accounts users can log in to with SASL
+	Accounts []AccountConfig `yaml:"accounts"`
+	// Connections over these limits are refused, see checkConnectionLimits
+	Limits LimitsConfig `yaml:"limits"`
+}
+
+// Each limit is off if 0
+type LimitsConfig struct {
+	// Connections to the whole server, registered or not
+	MaxClients int `yaml:"max_clients"`
+	// Connections from the same IP, or range of IPs with ipv4_cidr and ipv6_cidr
+	MaxPerIP int `yaml:"max_per_ip"`
+	// How many connections from the same IP can be opened in throttle_window
+	ThrottleCount  int           `yaml:"throttle_count"`
+	ThrottleWindow time.Duration `yaml:"throttle_window"`
+	// Prefix lengths of the ranges of IPs which share limits
+	IPv4Cidr int `yaml:"ipv4_cidr"`
+	IPv6Cidr int `yaml:"ipv6_cidr"`
+	// IPs or CIDR ranges no limits apply to, such as web gateways
+	Exempt []string `yaml:"exempt"`
+}
+
+type AdminConfig struct {
+	// Such as the city and country the server is in
+	Location string `yaml:"location"`
+	// Such as the organisation running the server
+	Organisation string `yaml:"organisation"`
+	Email        string `yaml:"email"`
+}
+
+// An address to accept client connections on
+type ListenerConfig struct {
+	// host:port, the host may be empty to listen on every interface.
+	// IPv6 addresses are written in brackets, such as "[::1]:6667".
+	// An absolute path listens on a Unix socket instead.
+	Address string `yaml:"address"`
+	// PEM files, set both to accept TLS connections.
+	// Reloaded from disk by REHASH.
+	Certificate string `yaml:"certificate"`
+	Key         string `yaml:"key"`
+	// Expect a PROXY protocol header before anything else, as sent by a load balancer
+	Proxy bool `yaml:"proxy"`
+	// IPs or CIDR ranges of the load balancers allowed to send the PROXY header, required with Proxy.
+	// Unix sockets don't need it, as only local users can connect.
+	ProxyFrom []string `yaml:"proxy_from"`
+	// Name of a ClassConfig, defaultClass if empty
+	Class string `yaml:"class"`
+}
+
+func (l ListenerConfig) isTLS() bool {
+	return len(l.Certificate) > 0 || len(l.Key) > 0
+}
+
+// "unix" or "tcp", as used by net.Listen
+func (l ListenerConfig) network() string {
+	if strings.HasPrefix(l.Address, "/") {
+		return "unix"
+	}
+	return "tcp"
+}
+
+func (l ListenerConfig) class() string {
+	if len(l.Class) == 0 {
+		return defaultClass
+	}
+	return l.Class
+}
+
+// Connections from listeners without a class use this one, which doesn't need to be defined
+const defaultClass = "default"
+
+// Settings for a group of client connections.
+// Settings left as zero use the value from defaultClassConfig, see findClass.
+type ClassConfig struct {
+	Name string `yaml:"name"`
+	// How long a connection can be idle before the server sends a PING
+	PingFrequency time.Duration `yaml:"ping_frequency"`
+	// How long to wait for a reply to the PING before disconnecting
+	PingTimeout time.Duration `yaml:"ping_timeout"`
+	// How long a connection has to finish registering
+	RegistrationTimeout time.Duration `yaml:"registration_timeout"`
+	// If set, connections must send this password with PASS. See hashPassword.
+	Password string `yaml:"password"`
+	// How many messages a client can send at once before flood control holds them back
+	FloodBurst int `yaml:"flood_burst"`
+	// After the burst, one message is handled this often
+	FloodInterval time.Duration `yaml:"flood_interval"`
+	// How many held back messages a client can have before it is disconnected for flooding
+	FloodLimit int `yaml:"flood_limit"`
+	// Connections in this class aren't held back, like opers
+	FloodExempt bool `yaml:"flood_exempt"`
+	// How many bytes can wait to be sent to a client before it is disconnected for reading too slowly
+	SendQ int `yaml:"sendq"`
+}
+
+var defaultClassConfig = ClassConfig{
+	Name:                defaultClass,
+	PingFrequency:       2 * time.Minute,
+	PingTimeout:         2 * time.Minute,
+	RegistrationTimeout: 30 * time.Second,
+	FloodBurst:          20,
+	FloodInterval:       time.Second / 2,
+	FloodLimit:          100,
+	SendQ:               400 * 1024,
+}
+
+// Returns the named class with defaults filled in, the default class if there isn't one
+func findClass(config Config, name string) ClassConfig {
+	class := defaultClassConfig
+	i := slices.IndexFunc(config.Classes, func(c ClassConfig) bool { return c.Name == name })
+	if i < 0 {
+		return class
+	}
+
+	configured := config.Classes[i]
+	class.Name = configured.Name
+	if configured.PingFrequency > 0 {
+		class.PingFrequency = configured.PingFrequency
+	}
+	if configured.PingTimeout > 0 {
+		class.PingTimeout = configured.PingTimeout
+	}
+	if configured.RegistrationTimeout > 0 {
+		class.RegistrationTimeout = configured.RegistrationTimeout
+	}
+	if configured.FloodBurst > 0 {
+		class.FloodBurst = configured.FloodBurst
+	}
+	if configured.FloodInterval > 0 {
+		class.FloodInterval = configured.FloodInterval
+	}
+	if configured.FloodLimit > 0 {
+		class.FloodLimit = configured.FloodLimit
+	}
+	if configured.SendQ > 0 {
+		class.SendQ = configured.SendQ
+	}
+	class.Password = configured.Password
+	class.FloodExempt = configured.FloodExempt
+	return class
+}
+
+// A gateway such as a web client, trusted to give the real address of its users with WEBIRC
+type WebircConfig struct {
+	Name string `yaml:"name"`
+	// See hashPassword
+	Password string `yaml:"password"`
+	// IPs or CIDR ranges the gateway connects from
+	Hosts []string `yaml:"hosts"`
+}
+
+// An account to log in to with SASL.
+// PLAIN checks the password, EXTERNAL the fingerprint of the TLS client certificate.
+type AccountConfig struct {
+	Name string `yaml:"name"`
+	// See hashPassword, PLAIN is not allowed if empty
+	Password string `yaml:"password"`
+	// Hex SHA-256 fingerprint, EXTERNAL is not allowed if empty
+	Certfp string `yaml:"certfp"`
+}
+
+// An operator block, used by OPER
+type OperConfig struct {
+	Name string `yaml:"name"`
+	// See hashPassword
+	Password string `yaml:"password"`
+	// user@host masks the operator can connect from
+	Hosts []string `yaml:"hosts"`
+	// Name of an OperClassConfig
+	Class string `yaml:"class"`
+}
+
+// A named set of privileges shared by operators
+type OperClassConfig struct {
+	Name       string   `yaml:"name"`
+	Privileges []string `yaml:"privileges"`
+}
+
+// Privileges which can be granted to an OperClassConfig
+var operPrivileges = []string{"die", "dline", "globops", "kill", "kline", "rehash", "restart", "stats", "wallops"}
+
+func DefaultConfig(serverName string) Config {
+	return Config{
+		Name:         serverName,
+		MonitorLimit: 100,
+		Casemapping:  "rfc1459",
+		NickLength:   30,
+		Limits: LimitsConfig{
+			MaxClients:     1000,
+			MaxPerIP:       10,
+			ThrottleCount:  10,
+			ThrottleWindow: time.Minute,
+			IPv4Cidr:       32,
+			IPv6Cidr:       64,
+		},
+	}
+}
+
+// Reads a YAML config file. Settings missing from the file keep the value from DefaultConfig.
+func LoadConfig(path string) (Config, error) {
+	config := DefaultConfig("")
+	config.Path = path
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&config)
+	if err != nil {
+		return config, fmt.Errorf("%v: %w", path, err)
+	}
+
+	err = config.validate()
+	if err != nil {
+		return config, fmt.Errorf("%v: %w", path, err)
+	}
+
+	return config, nil
+}
+
+// Returns every problem found, rather than stopping at the first
+func (config Config) validate() error {
+	problems := []error{}
+	var problem = func(format string, a ...any) {
+		problems = append(problems, fmt.Errorf(format, a...))
+	}
+
+	if len(config.Name) == 0 {
+		problem("name must be set")
+	}
+	if len(config.Listeners) == 0 {
+		problem("at least one listener is required")
+	}
+	connectionClasses := []string{defaultClass}
+	for _, class := range config.Classes {
+		if len(class.Name) == 0 {
+			problem("classes: every class needs a name")
+		} else if slices.Contains(connectionClasses[1:], class.Name) {
+			problem("classes: class %q is defined more than once", class.Name)
+		}
+		connectionClasses = append(connectionClasses, class.Name)
+
+		if class.PingFrequency < 0 || class.PingTimeout < 0 || class.RegistrationTimeout < 0 {
+			problem("class %q: ping_frequency, ping_timeout and registration_timeout must not be negative", class.Name)
+		}
+		if class.FloodBurst < 0 || class.FloodInterval < 0 || class.FloodLimit < 0 {
+			problem("class %q: flood_burst, flood_interval and flood_limit must not be negative", class.Name)
+		}
+		// Left out if zero, but otherwise must fit at least one line
+		if class.SendQ != 0 && class.SendQ < maxLineLength {
+			problem("class %q: sendq must be at least %v bytes", class.Name, maxLineLength)
+		}
+		if len(class.Password) > 0 && !isPasswordHash(class.Password) {
+			problem("class %q: password must be a hash from mkpasswd", class.Name)
+		}
+	}
+
+	for i, l := range config.Listeners {
+		_, _, err := net.SplitHostPort(l.Address)
+		if err != nil && l.network() == "tcp" {
+			problem("listeners[%v]: invalid address %q, expected host:port or the path of a Unix socket", i, l.Address)
+		}
+		if !slices.Contains(connectionClasses, l.class()) {
+			problem("listeners[%v]: unknown class %q", i, l.Class)
+		}
+		if l.Proxy && l.network() == "tcp" && len(l.ProxyFrom) == 0 {
+			problem("listeners[%v]: proxy_from is required with proxy", i)
+		}
+		for _, mask := range l.ProxyFrom {
+			if !isValidIPMask(mask) {
+				problem("listeners[%v]: invalid proxy_from host %q, expected an IP or CIDR range", i, mask)
+			}
+		}
+		if l.isTLS() && (len(l.Certificate) == 0 || len(l.Key) == 0) {
+			problem("listeners[%v]: certificate and key must both be set", i)
+		} else if l.isTLS() {
+			_, err = tls.LoadX509KeyPair(l.Certificate, l.Key)
+			if err != nil {
+				problem("listeners[%v]: %v", i, err)
+			}
+		}
+	}
+	if len(config.MotdFile) > 0 {
+		_, err := os.Stat(config.MotdFile)
+		if err != nil {
+			problem("motd_file: %v", err)
+		}
+	}
+	if config.MonitorLimit < 0 {
+		problem("monitor_limit must not be negative")
+	}
+	if _, valid := casemappings[config.Casemapping]; !valid {
+		problem("casemapping: unsupported casemapping %q", config.Casemapping)
+	}
+	if config.NickLength < 1 {
+		problem("nick_length must be at least 1")
+	}
+	if len(config.CloakKey) > 0 && len(config.CloakKey) < minCloakKeyLength {
+		problem("cloak_key must be at least %v characters", minCloakKeyLength)
+	}
+
+	limits := config.Limits
+	if limits.MaxClients < 0 || limits.MaxPerIP < 0 || limits.ThrottleCount < 0 || limits.ThrottleWindow < 0 {
+		problem("limits: max_clients, max_per_ip, throttle_count and throttle_window must not be negative")
+	}
+	if limits.ThrottleCount > 0 && limits.ThrottleWindow == 0 {
+		problem("limits: throttle_window is required with throttle_count")
+	}
+	if limits.IPv4Cidr < 0 || limits.IPv4Cidr > 32 || limits.IPv6Cidr < 0 || limits.IPv6Cidr > 128 {
+		problem("limits: ipv4_cidr must be from 0 to 32 and ipv6_cidr from 0 to 128")
+	}
+	for _, mask := range limits.Exempt {
+		if !isValidIPMask(mask) {
+			problem("limits: invalid exempt host %q, expected an IP or CIDR range", mask)
+		}
+	}
+
+	classes := []string{}
+	for _, class := range config.OperClasses {
+		if len(class.Name) == 0 {
+			problem("oper_classes: every class needs a name")
+		} else if slices.Contains(classes, class.Name) {
+			problem("oper_classes: class %q is defined more than once", class.Name)
+		}
+		classes = append(classes, class.Name)
+
+		for _, privilege := range class.Privileges {
+			if !slices.Contains(operPrivileges, privilege) {
+				problem("oper class %q: unknown privilege %q", class.Name, privilege)
+			}
+		}
+	}
+
+	opers := []string{}
+	for _, oper := range config.Opers {
+		if len(oper.Name) == 0 {
+			problem("opers: every oper needs a name")
+		} else if slices.Contains(opers, oper.Name) {
+			problem("opers: oper %q is defined more than once", oper.Name)
+		}
+		opers = append(opers, oper.Name)
+
+		if !isPasswordHash(oper.Password) {
+			problem("oper %q: password must be a hash from mkpasswd", oper.Name)
+		}
+		if len(oper.Hosts) == 0 {
+			problem("oper %q: at least one host is required", oper.Name)
+		}
+		if !slices.Contains(classes, oper.Class) {
+			problem("oper %q: unknown class %q", oper.Name, oper.Class)
+		}
+	}
+
+	for _, webirc := range config.Webirc {
+		if len(webirc.Name) == 0 {
+			problem("webirc: every gateway needs a name")
+		}
+		if !isPasswordHash(webirc.Password) {
+			problem("webirc %q: password must be a hash from mkpasswd", webirc.Name)
+		}
+		if len(webirc.Hosts) == 0 {
+			problem("webirc %q: at least one host is required", webirc.Name)
+		}
+		for _, host := range webirc.Hosts {
+			if !isValidIPMask(host) {
+				problem("webirc %q: invalid host %q, expected an IP or CIDR range", webirc.Name, host)
+			}
+		}
+	}
+
+	accounts := []string{}
+	for _, account := range config.Accounts {
+		if len(account.Name) == 0 {
+			problem("accounts: every account needs a name")
+		} else if slices.Contains(accounts, account.Name) {
+			problem("accounts: account %q is defined more than once", account.Name)
+		}
+		accounts = append(accounts, account.Name)
+
+		if len(account.Password) == 0 && len(account.Certfp) == 0 {
+			problem("account %q: a password or certfp is required", account.Name)
+		}
+		if len(account.Password) > 0 && !isPasswordHash(account.Password) {
+			problem("account %q: password must be a hash from mkpasswd", account.Name)
+		}
+		if len(account.Certfp) > 0 && !isCertificateFingerprint(account.Certfp) {
+			problem("account %q: certfp must be a hex SHA-256 fingerprint", account.Name)
+		}
+	}
+
+	return errors.Join(problems...)
+}
+
+// Returns no lines if path is empty
+func loadMotd(path string) ([]string, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	text := strings.TrimRight(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	if len(text) == 0 {
+		return nil, nil
+	}
+	return strings.Split(text, "\n"), nil
+}
+
+// Reloads the config file the server was started with.
+// Returns a description of each change, or why the new config was rejected.
+func rehash(server ServerInfo) ([]string, error) {
+	if len(server.configPath) == 0 {
+		return nil, errors.New("the server was not started with a config file")
+	}
+
+	config, err := LoadConfig(server.configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = server.certificates.reload()
+	if err != nil {
+		return nil, fmt.Errorf("could not reload certificates: %w", err)
+	}
+
+	responseChan := make(chan rehashResult, 1)
+	server.rehashChan <- Rehash{config, responseChan}
+	result := <-responseChan
+	return result.changes, result.err
+}
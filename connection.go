@@ -2,70 +2,238 @@ package main
 
 import (
 	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 type connectionState struct {
-	connection  net.Conn
-	host        string
-	nick        string
-	user        string
-	realName    string
-	messageChan chan string
-	quit        chan bool
+	// Assigned by the server when the connection is opened
+	id         string
+	connection net.Conn
+	host       string
+	// The ClassConfig of the listener which accepted the connection
+	class ClassConfig
+	// Empty if the connection is not over IP
+	ip string
+	// Set once the TLS handshake completes
+	secure bool
+	// SHA-256 fingerprint of the TLS client certificate, empty if there isn't one
+	certfp   string
+	nick     string
+	user     string
+	realName string
+	// How far through registration the connection is, see continueRegistration
+	phase registrationPhase
+	// Given with PASS, checked against the class password
+	password string
+	// Registration is held back until CAP END once the client starts negotiating
+	negotiatingCaps bool
+	// Registration is also held back while SASL authentication is in progress
+	sasl saslState
+	// The AccountConfig logged in to with SASL
+	account      string
+	capabilities map[string]bool
+	// Created by the server with the class's SendQ limit
+	sendq *sendQueue
+	quit  chan bool
+	stats *connectionStats
 }
 
+// Including the trailing "\r\n"
+const maxLineLength = 512
+
+// How long a TLS client has to complete the handshake
+const handshakeTimeout = 10 * time.Second
+
+// Capabilities which can be enabled with CAP REQ
+var supportedCapabilities = []string{"chghost", "sasl", "setname"}
+
+// Handles a connection in the default class, see newClassConnection
 func newIrcConnection(server ServerInfo, connection net.Conn) {
+	newClassConnection(server, connection, defaultClass)
+}
+
+func newClassConnection(server ServerInfo, connection net.Conn, class string) {
 	state := connectionState{
-		connection:  connection,
-		host:        connection.RemoteAddr().String(),
-		nick:        "",
-		user:        "",
-		realName:    "",
-		messageChan: make(chan string, 1),
-		quit:        make(chan bool),
+		connection:   connection,
+		host:         formatHost(connection.RemoteAddr()),
+		ip:           remoteIP(connection),
+		nick:         "",
+		user:         "",
+		realName:     "",
+		capabilities: make(map[string]bool),
+		quit:         make(chan bool, 1),
+		stats:        &connectionStats{},
 	}
 
-	sendCommandToServer(server.commandChan, CONNECTION_OPENED, "", []string{})
+	responseChan := make(chan OpenedConnection, 1)
+	server.connectionChan <- NewConnection{state.host, state.ip, class, state.quit, state.stats, responseChan}
+	opened := <-responseChan
+	if len(opened.refused) > 0 {
+		// Nothing has been started yet, so there is nothing else to clean up.
+		// On TLS listeners the write runs the handshake, which reads too, so bound both.
+		connection.SetDeadline(time.Now().Add(handshakeTimeout))
+		fmt.Fprintf(connection, "ERROR :Closing Link: %v %v\r\n", state.host, opened.refused)
+		connection.Close()
+		return
+	}
+	state.id = opened.id
+	state.class = opened.class
+	state.sendq = opened.sendq
 
 	// read/write handler
 	// TODO: Check this quits correctly
 	go func() {
-		reader := bufio.NewReader(connection)
-
-		for {
-			// Should split on "\r\n"
-			// See https://pkg.go.dev/bufio#Scanner & implementation of SplitLine
-			// Could not get it to correctly handle EOF.
-			netData, err := reader.ReadString('\n')
+		tlsConnection, isTLS := connection.(*tls.Conn)
+		if isTLS {
+			err := completeHandshake(&state, tlsConnection)
 			if err != nil {
 				fmt.Println(err.Error())
-				state.quit <- true
+				requestQuit(state.quit)
+				return
+			}
+		}
+		// Unix sockets and pipes have no IP to look up
+		if len(state.ip) > 0 {
+			resolveHost(server, &state)
+		}
+
+		// Reads lines for the loop below, which may hold them back for flood control
+		lines := make(chan readResult)
+		done := make(chan bool)
+		defer close(done)
+		go readLines(connection, lines, done)
+
+		flood := newFloodControl(state.class)
+		// Idle connections are sent a PING with this token, and closed if they don't answer
+		pingToken := ""
+		lastActive := time.Now()
+		registrationDeadline := lastActive.Add(state.class.RegistrationTimeout)
+
+		for {
+			deadline := lastActive.Add(state.class.PingFrequency)
+			if len(pingToken) > 0 {
+				deadline = deadline.Add(state.class.PingTimeout)
+			}
+			if !isRegistered(state) && registrationDeadline.Before(deadline) {
+				deadline = registrationDeadline
+			}
+			if readyAt := flood.readyAt(time.Now()); !readyAt.IsZero() && readyAt.Before(deadline) {
+				deadline = readyAt
+			}
+			timer := time.NewTimer(time.Until(deadline))
+
+			select {
+			case r := <-lines:
+				timer.Stop()
+				if errors.Is(r.err, errLineTooLong) {
+					closeConnection(server, &state, "Line too long")
+					return
+				}
+				if r.err != nil {
+					fmt.Println(r.err.Error())
+					requestQuit(state.quit)
+					return
+				}
+
+				// Only a PONG answering the PING shows the client is still there
+				if command, params := tokenize(r.line); command != "PONG" || (len(params) > 0 && params[len(params)-1] == pingToken) {
+					lastActive = time.Now()
+					pingToken = ""
+				}
+				state.stats.messagesIn.Add(1)
+				state.stats.bytesIn.Add(int64(len(r.line)))
+
+				if !flood.push(r.line) && !isFloodExempt(server, &state) {
+					sendCommandToServer(server.commandChan, EXCESS_FLOOD, state.nick, []string{state.host})
+					closeConnection(server, &state, "Excess Flood")
+					return
+				}
+			case <-state.sendq.full:
+				// The client isn't reading, so the writer may be stuck until the connection is closed
+				timer.Stop()
+				closeConnection(server, &state, "Max SendQ exceeded")
+				connection.Close()
 				return
+			case <-timer.C:
+				now := time.Now()
+				if !isRegistered(state) && !now.Before(registrationDeadline) {
+					closeConnection(server, &state, "Registration timed out")
+					return
+				}
+				if now.Before(lastActive.Add(state.class.PingFrequency)) {
+					break
+				}
+				if len(pingToken) == 0 {
+					pingToken = newPingToken()
+					state.sendq.send(fmt.Sprintf("PING :%v\r\n", pingToken))
+				} else if !now.Before(lastActive.Add(state.class.PingFrequency + state.class.PingTimeout)) {
+					closeConnection(server, &state, fmt.Sprintf("Ping timeout: %v seconds", int(now.Sub(lastActive).Seconds())))
+					return
+				}
 			}
 
-			// TODO: remove pointers
-			_ = handleIrcMessage(server, &state, netData)
-			// for r := range responseChan {
-			// 	state.messageChan <- r
-			// }
+			// Handle whatever the flood control allows, in order
+			for {
+				readyAt := flood.readyAt(time.Now())
+				if readyAt.IsZero() {
+					break
+				}
+				exempt := state.class.FloodExempt
+				if readyAt.After(time.Now()) {
+					// Only asked when the message would be held back, so most messages don't need it
+					if !isFloodExempt(server, &state) {
+						break
+					}
+					exempt = true
+				}
+
+				handleIrcMessage(server, &state, flood.pop(time.Now(), exempt))
+				// Such as after a bad password, so nothing sent after it is handled
+				if state.phase == phaseClosed {
+					return
+				}
+			}
 		}
 	}()
 
 	go func() {
 		// TODO: This is poorly tested
-		defer sendCommandToServer(server.commandChan, CONNECTION_CLOSED, state.nick, []string{})
+		defer func() {
+			sendCommandToServer(server.commandChan, CONNECTION_CLOSED, state.nick, []string{state.id})
+		}()
 
 		writer := bufio.NewWriter(connection)
+		// A message may hold several lines
+		var write = func(message string) {
+			writer.WriteString(message)
+			state.stats.messagesOut.Add(int64(strings.Count(message, "\n")))
+			state.stats.bytesOut.Add(int64(len(message)))
+		}
 
 		for {
 			select {
-			case message := <-state.messageChan:
-				writer.WriteString(message)
-				writer.Flush()
+			case <-state.sendq.ready:
+				for _, message := range state.sendq.take() {
+					write(message)
+					writer.Flush()
+				}
 			case <-state.quit:
+				// Send anything already queued, such as an ERROR line
+				for _, message := range state.sendq.take() {
+					write(message)
+				}
+				writer.Flush()
 				connection.Close()
 				return
 			}
@@ -79,38 +247,41 @@ func newIrcConnection(server ServerInfo, connection net.Conn) {
 }
 
 func handleIrcMessage(server ServerInfo, state *connectionState, message string) (responseChan chan string) {
-	respondMultiple := func(channel chan<- string, response []string) {
+	respondMultiple := func(sendq *sendQueue, response []string) {
 		for _, r := range response {
-			channel <- r
+			sendq.send(r)
 		}
 	}
 
-	go func() {
-		command, params := tokenize(message)
-
-		// Slightly hacky special case to avoid editing all command handlers
-		// TODO: May need to change anyway in the future.
-		if command == "QUIT" {
-			response, quit := handleQuit(server, state, params)
-			respondMultiple(state.messageChan, response)
-			if quit {
-				state.quit <- true
-			}
-			return
+	command, params := tokenize(message)
+	// WEBIRC has to come before anything else
+	if state.phase == phaseConnected && command != "WEBIRC" {
+		state.phase = phaseRegistering
+	}
+
+	// Slightly hacky special case to avoid editing all command handlers
+	// TODO: May need to change anyway in the future.
+	if command == "QUIT" {
+		server.usage.record(command, len(message))
+		response, quit := handleQuit(server, state, params)
+		respondMultiple(state.sendq, response)
+		if quit {
+			requestQuit(state.quit)
 		}
+		return
+	}
 
-		handler, valid_command := ircCommands[command]
-		if !valid_command {
-			nick := state.nick
-			if len(nick) == 0 {
-				nick = "*"
-			}
-			state.messageChan <- fmt.Sprintf(":%v 421 %v %v :Unknown command\r\n", server.name, nick, command)
-			return
+	handler, valid_command := ircCommands[command]
+	if !valid_command {
+		nick := state.nick
+		if len(nick) == 0 {
+			nick = "*"
 		}
-		handler(server, state, params)
+		state.sendq.send(fmt.Sprintf(":%v 421 %v %v :Unknown command\r\n", server.name, nick, command))
 		return
-	}()
+	}
+	server.usage.record(command, len(message))
+	handler(server, state, params)
 
 	return
 }
@@ -118,23 +289,48 @@ func handleIrcMessage(server ServerInfo, state *connectionState, message string)
 // Commands
 // Dispatch table
 var ircCommands = map[string](func(ServerInfo, *connectionState, []string)){
-	"NICK": handleNick,
-	"USER": handleUser,
+	"NICK":         handleNick,
+	"USER":         handleUser,
+	"PASS":         handlePass,
+	"WEBIRC":       handleWebirc,
+	"AUTHENTICATE": handleAuthenticate,
 	// "QUIT": handleQuit,
-	"PRIVMSG": handlePrivmsg,
-	"NOTICE":  handleNotice,
-	"PING":    handlePing,
-	"PONG":    handlePong,
-	"MOTD":    handleMotd,
-	"LUSERS":  handleLusers,
-	"WHOIS":   handleWhois,
-	"JOIN":    handleJoin,
-	"PART":    handlePart,
-	"TOPIC":   handleTopic,
-	"AWAY":    handleAway,
-	"NAMES":   handleNames,
-	"LIST":    handleList,
-	"WHO":     handleWho,
+	"PRIVMSG":  handlePrivmsg,
+	"NOTICE":   handleNotice,
+	"PING":     handlePing,
+	"PONG":     handlePong,
+	"MOTD":     handleMotd,
+	"LUSERS":   handleLusers,
+	"WHOIS":    handleWhois,
+	"JOIN":     handleJoin,
+	"PART":     handlePart,
+	"TOPIC":    handleTopic,
+	"AWAY":     handleAway,
+	"NAMES":    handleNames,
+	"LIST":     handleList,
+	"WHO":      handleWho,
+	"ISON":     handleIson,
+	"USERHOST": handleUserhost,
+	"MONITOR":  handleMonitor,
+	"CAP":      handleCap,
+	"SETNAME":  handleSetname,
+	"OPER":     handleOper,
+	"MODE":     handleMode,
+	"KILL":     handleKill,
+	"WALLOPS":  handleWallops,
+	"GLOBOPS":  handleGlobops,
+	"KLINE":    handleKline,
+	"UNKLINE":  handleUnkline,
+	"DLINE":    handleDline,
+	"UNDLINE":  handleUndline,
+	"REHASH":   handleRehash,
+	"STATS":    handleStats,
+	"ADMIN":    handleAdmin,
+	"INFO":     handleInfo,
+	"VERSION":  handleVersion,
+	"TIME":     handleTime,
+	"DIE":      handleDie,
+	"RESTART":  handleRestart,
 }
 
 // Registers the user with a unique identifier
@@ -144,32 +340,25 @@ func handleNick(server ServerInfo, state *connectionState, params []string) {
 		if !isRegistered(*state) {
 			nick = "*"
 		}
-		state.messageChan <- fmt.Sprintf(":%v 431 %v :No nickname given\r\n", server.name, nick)
+		state.sendq.send(fmt.Sprintf(":%v 431 %v :No nickname given\r\n", server.name, nick))
 		return
 	}
 
 	if isRegistered(*state) {
 		// 1: already registered
+		// The server tells everyone who shares a channel, including us
 		err := trySetNick(server, state.nick, params[0])
 		if err != nil {
-			state.messageChan <- err.Error()
+			state.sendq.send(err.Error())
 			return
 		}
 
-		oldNick := state.nick
-		state.nick = params[0]
-		state.messageChan <- fmt.Sprintf(":%v NICK %v\r\n", oldNick, state.nick)
-	} else if len(state.user) == 0 {
-		// 2: no user details
 		state.nick = params[0]
-		state.messageChan <- "\r\n"
 	} else {
-		response := tryRegister(server, state, params[0])
-		for _, r := range response {
-			state.messageChan <- r
-		}
+		// 2: registers if everything else is ready
+		state.nick = params[0]
+		continueRegistration(server, state)
 	}
-
 }
 
 // Additional data about the user.
@@ -180,26 +369,17 @@ func handleUser(server ServerInfo, state *connectionState, params []string) {
 	}
 
 	if len(params) < 4 {
-		state.messageChan <- errNeedMoreParams(server.name, nick, "USER")
+		state.sendq.send(errNeedMoreParams(server.name, nick, "USER"))
 		return
 	}
 	if len(state.user) > 0 {
-		state.messageChan <- fmt.Sprintf(":%v 462 %v :Unauthorized command (already registered)\r\n", server.name, nick)
+		state.sendq.send(fmt.Sprintf(":%v 462 %v :Unauthorized command (already registered)\r\n", server.name, nick))
 		return
 	}
 
 	state.user = params[0]
 	state.realName = params[3]
-
-	if len(state.nick) == 0 {
-		state.messageChan <- "\r\n"
-		return
-	} else {
-		for _, r := range tryRegister(server, state, nick) {
-			state.messageChan <- r
-		}
-		return
-	}
+	continueRegistration(server, state)
 }
 
 // End the session. Should respond and then end the connection.
@@ -208,8 +388,6 @@ func handleQuit(server ServerInfo, state *connectionState, params []string) (res
 		return []string{errUnregistered(server.name, state.nick)}, false
 	}
 
-	sendCommandToServer(server.commandChan, QUIT, state.nick, []string{})
-
 	message := ""
 	if len(params) == 0 {
 		message = "Client Quit"
@@ -217,142 +395,165 @@ func handleQuit(server ServerInfo, state *connectionState, params []string) (res
 		message = params[0]
 	}
 
+	sendCommandToServer(server.commandChan, QUIT, state.nick, []string{message})
+
 	return []string{fmt.Sprintf(":%v ERROR :Closing Link: %v %v\r\n", server.name, state.host, message)}, true
 }
 
 func handlePrivmsg(server ServerInfo, state *connectionState, params []string) {
 	if !isRegistered(*state) {
-		state.messageChan <- errUnregistered(server.name, state.nick)
+		state.sendq.send(errUnregistered(server.name, state.nick))
 		return
 	}
 	if len(params) == 0 {
-		state.messageChan <- fmt.Sprintf(":%v 411 %v :No recipient given (PRIVMSG)\r\n", server.name, state.nick)
+		state.sendq.send(fmt.Sprintf(":%v 411 %v :No recipient given (PRIVMSG)\r\n", server.name, state.nick))
 		return
 	}
 	if len(params) == 1 {
-		state.messageChan <- fmt.Sprintf(":%v 412 %v :No text to send\r\n", server.name, state.nick)
+		state.sendq.send(fmt.Sprintf(":%v 412 %v :No text to send\r\n", server.name, state.nick))
 		return
 	}
 
-	message := fmt.Sprintf(":%v!%v@%v PRIVMSG %v :%v\r\n", state.nick, state.user, state.host, params[0], params[1])
-	result, _ := sendCommandToServer(server.commandChan, PRIVMSG, state.nick, []string{params[0], message})
+	result, _ := sendCommandToServer(server.commandChan, PRIVMSG, state.nick, []string{params[0], params[1]})
 
 	if result == ERR_NOSUCHNICKNAME {
-		state.messageChan <- fmt.Sprintf(":%v 401 %v %v :No such nick/channel\r\n", server.name, state.nick, params[0])
+		state.sendq.send(fmt.Sprintf(":%v 401 %v %v :No such nick/channel\r\n", server.name, state.nick, params[0]))
 		return
 	}
 
-	state.messageChan <- "\r\n"
+	state.sendq.send("\r\n")
 }
 
 func handleNotice(server ServerInfo, state *connectionState, params []string) {
 	if !isRegistered(*state) {
 		// FIXME: should this error?
-		state.messageChan <- errUnregistered(server.name, state.nick)
+		state.sendq.send(errUnregistered(server.name, state.nick))
 		return
 	}
 	if len(params) < 2 {
-		state.messageChan <- "\r\n"
+		state.sendq.send("\r\n")
 		return
 	}
 
-	message := fmt.Sprintf(":%v!%v@%v NOTICE %v :%v\r\n", state.nick, state.user, state.host, params[0], params[1])
-	sendCommandToServer(server.commandChan, PRIVMSG, state.nick, []string{params[0], message})
-	state.messageChan <- "\r\n"
+	sendCommandToServer(server.commandChan, NOTICE, state.nick, []string{params[0], params[1]})
+	state.sendq.send("\r\n")
 }
 
 func handlePing(server ServerInfo, state *connectionState, params []string) {
 	if !isRegistered(*state) {
-		state.messageChan <- errUnregistered(server.name, state.nick)
+		state.sendq.send(errUnregistered(server.name, state.nick))
 		return
 	}
 	if len(params) < 1 {
-		state.messageChan <- errNeedMoreParams(server.name, state.nick, "PING")
+		state.sendq.send(errNeedMoreParams(server.name, state.nick, "PING"))
 		return
 	}
 
-	state.messageChan <- fmt.Sprintf(":%v PONG %v %v\r\n", server.name, server.name, params[0])
+	state.sendq.send(fmt.Sprintf(":%v PONG %v %v\r\n", server.name, server.name, params[0]))
 }
 
+// The token is checked against the server's PING by the reader in newClassConnection
 func handlePong(server ServerInfo, state *connectionState, params []string) {
 	// TODO: Should we actually do this check?
 	if !isRegistered(*state) {
-		state.messageChan <- errUnregistered(server.name, state.nick)
+		state.sendq.send(errUnregistered(server.name, state.nick))
 		return
 	}
-	state.messageChan <- "\r\n"
+	state.sendq.send("\r\n")
 }
 
 func handleMotd(server ServerInfo, state *connectionState, params []string) {
 	if !isRegistered(*state) {
-		state.messageChan <- errUnregistered(server.name, state.nick)
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+
+	if !isThisServer(server, state, params) {
 		return
 	}
 
-	state.messageChan <- fmt.Sprintf(":%v 422 %v :MOTD not implemented\r\n", server.name, state.nick)
+	for _, r := range rplMotd(server, state.nick) {
+		state.sendq.send(r)
+	}
 }
 
 func handleLusers(server ServerInfo, state *connectionState, params []string) {
 	if !isRegistered(*state) {
-		state.messageChan <- errUnregistered(server.name, state.nick)
+		state.sendq.send(errUnregistered(server.name, state.nick))
 		return
 	}
 
-	clients, _ := sendCommandToServer(server.commandChan, N_CONNECTIONS, state.nick, params)
-	users, _ := sendCommandToServer(server.commandChan, N_USERS, state.nick, params)
-	invisible := 0
-	servers := 0
-	operators := 0
-	unknown := clients - users
-	channels := 0
-	// FIXME: Should this be users + unknown + invisible?
-	response := []string{
-		fmt.Sprintf(":%v 251 %v :There are %v users and %v invisible on %v servers\r\n", server.name, state.nick, users, invisible, servers),
-		fmt.Sprintf(":%v 252 %v %v :operator(s) online\r\n", server.name, state.nick, operators),
-		fmt.Sprintf(":%v 253 %v %v :unknown connection(s)\r\n", server.name, state.nick, unknown),
-		fmt.Sprintf(":%v 254 %v %v :channels formed\r\n", server.name, state.nick, channels),
-		fmt.Sprintf(":%v 255 %v :I have %v clients and %v servers\r\n", server.name, state.nick, clients, servers),
+	for _, r := range rplLusers(server, state.nick) {
+		state.sendq.send(r)
 	}
-	for _, r := range response {
-		state.messageChan <- r
+}
+
+// Records the client certificate before any messages are read
+func completeHandshake(state *connectionState, connection *tls.Conn) error {
+	connection.SetDeadline(time.Now().Add(handshakeTimeout))
+	err := connection.Handshake()
+	if err != nil {
+		return err
 	}
+	connection.SetDeadline(time.Time{})
+
+	state.secure = true
+	state.certfp = certificateFingerprint(connection.ConnectionState())
+	return nil
 }
 
 func handleWhois(server ServerInfo, state *connectionState, params []string) {
 	if !isRegistered(*state) {
-		state.messageChan <- errUnregistered(server.name, state.nick)
+		state.sendq.send(errUnregistered(server.name, state.nick))
 		return
 	}
 	if len(params) < 1 {
-		state.messageChan <- "\r\n"
+		state.sendq.send("\r\n")
 		return
 	}
 
 	targetNick := params[0]
 	result, targetHost := sendCommandToServer(server.commandChan, GET_HOST_NAME, state.nick, params[:1])
 	if result == ERR_NOSUCHNICKNAME {
-		state.messageChan <- fmt.Sprintf(":%v 401 %v %v :No such nick/channel\r\n", server.name, state.nick, params[0])
+		state.sendq.send(fmt.Sprintf(":%v 401 %v %v :No such nick/channel\r\n", server.name, state.nick, params[0]))
 		return
 	}
 	_, targetName := sendCommandToServer(server.commandChan, GET_REAL_NAME, state.nick, params[:1])
 
+	result, certfp := sendCommandToServer(server.commandChan, GET_SECURE, state.nick, params[:1])
+
 	response := []string{
 		fmt.Sprintf(":%v 311 %v %v %v %v :%v\r\n", server.name, state.nick, targetNick, targetNick, targetHost, targetName),
 		fmt.Sprintf(":%v 312 %v %v %v :Toy server\r\n", server.name, state.nick, targetNick, server.name),
-		fmt.Sprintf(":%v 318 %v %v :End of /WHOIS list\r\n", server.name, state.nick, targetNick),
 	}
+	if result == OK {
+		response = append(response, fmt.Sprintf(":%v 671 %v %v :is using a secure connection\r\n", server.name, state.nick, targetNick))
+	}
+	// Only worth showing if the host is hidden
+	result, realHost := sendCommandToServer(server.commandChan, GET_REAL_HOST, state.nick, params[:1])
+	if result == OK && !strings.HasPrefix(realHost+" ", targetHost+" ") {
+		response = append(response, fmt.Sprintf(":%v 378 %v %v :is connecting from *@%v\r\n", server.name, state.nick, targetNick, realHost))
+	}
+	_, account := sendCommandToServer(server.commandChan, GET_ACCOUNT, state.nick, params[:1])
+	if len(account) > 0 {
+		response = append(response, fmt.Sprintf(":%v 330 %v %v %v :is logged in as\r\n", server.name, state.nick, targetNick, account))
+	}
+	if len(certfp) > 0 {
+		response = append(response, fmt.Sprintf(":%v 276 %v %v :has client certificate fingerprint %v\r\n", server.name, state.nick, targetNick, certfp))
+	}
+	response = append(response, fmt.Sprintf(":%v 318 %v %v :End of /WHOIS list\r\n", server.name, state.nick, targetNick))
 	for _, r := range response {
-		state.messageChan <- r
+		state.sendq.send(r)
 	}
 }
 
 func handleJoin(server ServerInfo, state *connectionState, params []string) {
 	if !isRegistered(*state) {
-		state.messageChan <- errUnregistered(server.name, state.nick)
+		state.sendq.send(errUnregistered(server.name, state.nick))
 		return
 	}
 	if len(params) < 1 {
-		state.messageChan <- errNeedMoreParams(server.name, state.nick, "JOIN")
+		state.sendq.send(errNeedMoreParams(server.name, state.nick, "JOIN"))
 		return
 	}
 
@@ -361,39 +562,39 @@ func handleJoin(server ServerInfo, state *connectionState, params []string) {
 
 func handlePart(server ServerInfo, state *connectionState, params []string) {
 	if !isRegistered(*state) {
-		state.messageChan <- errUnregistered(server.name, state.nick)
+		state.sendq.send(errUnregistered(server.name, state.nick))
 		return
 	}
 	if len(params) < 1 {
-		state.messageChan <- errNeedMoreParams(server.name, state.nick, "PART")
+		state.sendq.send(errNeedMoreParams(server.name, state.nick, "PART"))
 		return
 	}
 	result, _ := sendCommandToServer(server.commandChan, PART, state.nick, params)
 
 	channel := params[0]
 	if result == ERR_NOSUCHCHANNEL {
-		state.messageChan <- fmt.Sprintf(":%v 403 %v %v :No such channel\r\n", server.name, state.nick, channel)
+		state.sendq.send(fmt.Sprintf(":%v 403 %v %v :No such channel\r\n", server.name, state.nick, channel))
 	} else if result == ERR_NOTONCHANNEL {
-		state.messageChan <- fmt.Sprintf(":%v 441 %v %v :You're not on that channel\r\n", server.name, state.nick, channel)
+		state.sendq.send(fmt.Sprintf(":%v 441 %v %v :You're not on that channel\r\n", server.name, state.nick, channel))
 	}
 }
 
 func handleTopic(server ServerInfo, state *connectionState, params []string) {
 	if !isRegistered(*state) {
-		state.messageChan <- errUnregistered(server.name, state.nick)
+		state.sendq.send(errUnregistered(server.name, state.nick))
 		return
 	}
 }
 func handleAway(server ServerInfo, state *connectionState, params []string) {
 	if !isRegistered(*state) {
-		state.messageChan <- errUnregistered(server.name, state.nick)
+		state.sendq.send(errUnregistered(server.name, state.nick))
 		return
 	}
 }
 
 func handleNames(server ServerInfo, state *connectionState, params []string) {
 	if !isRegistered(*state) {
-		state.messageChan <- errUnregistered(server.name, state.nick)
+		state.sendq.send(errUnregistered(server.name, state.nick))
 		return
 	}
 
@@ -402,27 +603,746 @@ func handleNames(server ServerInfo, state *connectionState, params []string) {
 
 func handleList(server ServerInfo, state *connectionState, params []string) {
 	if !isRegistered(*state) {
-		state.messageChan <- errUnregistered(server.name, state.nick)
+		state.sendq.send(errUnregistered(server.name, state.nick))
 		return
 	}
 }
 func handleWho(server ServerInfo, state *connectionState, params []string) {
 	if !isRegistered(*state) {
-		state.messageChan <- errUnregistered(server.name, state.nick)
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+}
+
+func handleIson(server ServerInfo, state *connectionState, params []string) {
+	if !isRegistered(*state) {
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+	if len(params) < 1 {
+		state.sendq.send(errNeedMoreParams(server.name, state.nick, "ISON"))
+		return
+	}
+
+	// Some clients send the nick list as a single trailing parameter
+	nicks := strings.Fields(strings.Join(params, " "))
+	_, online := sendCommandToServer(server.commandChan, ISON, state.nick, nicks)
+
+	state.sendq.send(fmt.Sprintf(":%v 303 %v :%v\r\n", server.name, state.nick, online))
+}
+
+func handleUserhost(server ServerInfo, state *connectionState, params []string) {
+	if !isRegistered(*state) {
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+	if len(params) < 1 {
+		state.sendq.send(errNeedMoreParams(server.name, state.nick, "USERHOST"))
+		return
+	}
+
+	// Only the first 5 nicks are looked up
+	nicks := strings.Fields(strings.Join(params, " "))
+	if len(nicks) > 5 {
+		nicks = nicks[:5]
+	}
+	_, replies := sendCommandToServer(server.commandChan, USERHOST, state.nick, nicks)
+
+	state.sendq.send(fmt.Sprintf(":%v 302 %v :%v\r\n", server.name, state.nick, replies))
+}
+
+func handleMonitor(server ServerInfo, state *connectionState, params []string) {
+	if !isRegistered(*state) {
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+	if len(params) < 1 {
+		state.sendq.send(errNeedMoreParams(server.name, state.nick, "MONITOR"))
+		return
+	}
+
+	subcommand := params[0]
+	switch subcommand {
+	case "+", "-":
+		if len(params) < 2 {
+			state.sendq.send(errNeedMoreParams(server.name, state.nick, "MONITOR"))
+			return
+		}
+	case "C", "L", "S":
+	default:
+		state.sendq.send("\r\n")
 		return
 	}
+
+	_, _ = sendCommandToServer(server.commandChan, MONITOR, state.nick, params)
+
+	// Only adding, listing and status requests get a reply
+	if subcommand == "-" || subcommand == "C" {
+		state.sendq.send("\r\n")
+	}
+}
+
+// Capability negotiation, see https://ircv3.net/specs/extensions/capability-negotiation
+func handleCap(server ServerInfo, state *connectionState, params []string) {
+	nick := state.nick
+	if !isRegistered(*state) {
+		nick = "*"
+	}
+	if len(params) < 1 {
+		state.sendq.send(errNeedMoreParams(server.name, nick, "CAP"))
+		return
+	}
+
+	subcommand := strings.ToUpper(params[0])
+	switch subcommand {
+	case "LS":
+		state.negotiatingCaps = !isRegistered(*state)
+		state.sendq.send(fmt.Sprintf(":%v CAP %v LS :%v\r\n", server.name, nick, strings.Join(supportedCapabilities, " ")))
+	case "LIST":
+		enabled := []string{}
+		for _, c := range supportedCapabilities {
+			if state.capabilities[c] {
+				enabled = append(enabled, c)
+			}
+		}
+		state.sendq.send(fmt.Sprintf(":%v CAP %v LIST :%v\r\n", server.name, nick, strings.Join(enabled, " ")))
+	case "REQ":
+		if len(params) < 2 {
+			state.sendq.send(errNeedMoreParams(server.name, nick, "CAP"))
+			return
+		}
+		state.negotiatingCaps = !isRegistered(*state)
+
+		// Requests are accepted or rejected as a whole
+		requested := strings.Fields(params[1])
+		for _, r := range requested {
+			if !slices.Contains(supportedCapabilities, strings.TrimPrefix(r, "-")) {
+				state.sendq.send(fmt.Sprintf(":%v CAP %v NAK :%v\r\n", server.name, nick, params[1]))
+				return
+			}
+		}
+		for _, r := range requested {
+			name, disable := strings.CutPrefix(r, "-")
+			state.capabilities[name] = !disable
+		}
+
+		if isRegistered(*state) {
+			sendCommandToServer(server.commandChan, SET_CAPABILITIES, state.nick, enabledCapabilities(*state))
+		}
+		state.sendq.send(fmt.Sprintf(":%v CAP %v ACK :%v\r\n", server.name, nick, params[1]))
+	case "END":
+		state.negotiatingCaps = false
+		continueRegistration(server, state)
+	default:
+		state.sendq.send(fmt.Sprintf(":%v 410 %v %v :Invalid CAP command\r\n", server.name, nick, params[0]))
+	}
+}
+
+// Changes the real name given by USER, see https://ircv3.net/specs/extensions/setname
+func handleSetname(server ServerInfo, state *connectionState, params []string) {
+	if !isRegistered(*state) {
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+	if !state.capabilities["setname"] {
+		state.sendq.send(fmt.Sprintf(":%v FAIL SETNAME CANNOT_CHANGE_REALNAME :The setname capability is not enabled\r\n", server.name))
+		return
+	}
+	if len(params) < 1 {
+		state.sendq.send(errNeedMoreParams(server.name, state.nick, "SETNAME"))
+		return
+	}
+	if len(strings.TrimSpace(params[0])) == 0 {
+		state.sendq.send(fmt.Sprintf(":%v FAIL SETNAME INVALID_REALNAME :Realname is not valid\r\n", server.name))
+		return
+	}
+
+	// The server echoes the change back to us
+	state.realName = params[0]
+	sendCommandToServer(server.commandChan, SET_REAL_NAME, state.nick, params[:1])
+}
+
+func handleOper(server ServerInfo, state *connectionState, params []string) {
+	if !isRegistered(*state) {
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+	if len(params) < 2 {
+		state.sendq.send(errNeedMoreParams(server.name, state.nick, "OPER"))
+		return
+	}
+
+	result, hash := sendCommandToServer(server.commandChan, GET_OPER_PASSWORD, state.nick, params[:1])
+	if result == OK {
+		if !checkPassword(hash, params[1]) {
+			hash = ""
+		}
+		result, _ = sendCommandToServer(server.commandChan, OPER, state.nick, []string{params[0], hash})
+	}
+	switch result {
+	case ERR_NOOPERHOST:
+		state.sendq.send(fmt.Sprintf(":%v 491 %v :No O-lines for your host\r\n", server.name, state.nick))
+	case ERR_PASSWDMISMATCH:
+		state.sendq.send(fmt.Sprintf(":%v 464 %v :Password incorrect\r\n", server.name, state.nick))
+	default:
+		state.sendq.send(fmt.Sprintf(":%v 381 %v :You are now an IRC operator\r\n", server.name, state.nick))
+		state.sendq.send(fmt.Sprintf(":%v MODE %v :+o\r\n", state.nick, state.nick))
+	}
+}
+
+// Only user modes are supported
+func handleMode(server ServerInfo, state *connectionState, params []string) {
+	if !isRegistered(*state) {
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+	if len(params) < 1 {
+		state.sendq.send(errNeedMoreParams(server.name, state.nick, "MODE"))
+		return
+	}
+
+	target := params[0]
+	if isChannelName(target) {
+		state.sendq.send(fmt.Sprintf(":%v 403 %v %v :No such channel\r\n", server.name, state.nick, target))
+		return
+	}
+	if server.casefold(target) != server.casefold(state.nick) {
+		state.sendq.send(fmt.Sprintf(":%v 502 %v :Cannot change mode for other users\r\n", server.name, state.nick))
+		return
+	}
+
+	if len(params) < 2 {
+		_, modes := sendCommandToServer(server.commandChan, GET_USER_MODES, state.nick, []string{})
+		state.sendq.send(fmt.Sprintf(":%v 221 %v %v\r\n", server.name, state.nick, modes))
+		return
+	}
+
+	result, response := sendCommandToServer(server.commandChan, SET_USER_MODES, state.nick, params[1:min(len(params), 3)])
+	changes, snomask, _ := strings.Cut(response, " ")
+	if result == ERR_UMODEUNKNOWNFLAG {
+		state.sendq.send(fmt.Sprintf(":%v 501 %v :Unknown MODE flag\r\n", server.name, state.nick))
+	}
+	if len(changes) > 0 {
+		state.sendq.send(fmt.Sprintf(":%v MODE %v :%v\r\n", state.nick, state.nick, changes))
+	}
+	if len(snomask) > 0 {
+		state.sendq.send(fmt.Sprintf(":%v 008 %v %v :Server notice mask\r\n", server.name, state.nick, snomask))
+	}
+	if len(changes) == 0 && len(snomask) == 0 && result != ERR_UMODEUNKNOWNFLAG {
+		state.sendq.send("\r\n")
+	}
+}
+
+// Disconnects another user
+func handleKill(server ServerInfo, state *connectionState, params []string) {
+	if !isRegistered(*state) {
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+	if len(params) < 2 {
+		state.sendq.send(errNeedMoreParams(server.name, state.nick, "KILL"))
+		return
+	}
+	if !checkPrivilege(server, state, "kill") {
+		return
+	}
+
+	result, _ := sendCommandToServer(server.commandChan, KILL, state.nick, params[:2])
+	if result == ERR_NOSUCHNICKNAME {
+		state.sendq.send(fmt.Sprintf(":%v 401 %v %v :No such nick/channel\r\n", server.name, state.nick, params[0]))
+		return
+	}
+
+	state.sendq.send("\r\n")
+}
+
+// Broadcasts to users with the +w mode
+func handleWallops(server ServerInfo, state *connectionState, params []string) {
+	if !isRegistered(*state) {
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+	if len(params) < 1 {
+		state.sendq.send(errNeedMoreParams(server.name, state.nick, "WALLOPS"))
+		return
+	}
+	if !checkPrivilege(server, state, "wallops") {
+		return
+	}
+
+	sendCommandToServer(server.commandChan, WALLOPS, state.nick, params[:1])
+	state.sendq.send("\r\n")
+}
+
+// Broadcasts to operators
+func handleGlobops(server ServerInfo, state *connectionState, params []string) {
+	if !isRegistered(*state) {
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+	if len(params) < 1 {
+		state.sendq.send(errNeedMoreParams(server.name, state.nick, "GLOBOPS"))
+		return
+	}
+	if !checkPrivilege(server, state, "globops") {
+		return
+	}
+
+	sendCommandToServer(server.commandChan, GLOBOPS, state.nick, params[:1])
+	state.sendq.send("\r\n")
+}
+
+// Bans a user@host mask, or the host of a nick.
+// KLINE [<minutes>] <mask> [:<reason>]
+func handleKline(server ServerInfo, state *connectionState, params []string) {
+	if !isRegistered(*state) {
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+	banParams, valid := parseBanParams(params)
+	if !valid {
+		state.sendq.send(errNeedMoreParams(server.name, state.nick, "KLINE"))
+		return
+	}
+	if !checkPrivilege(server, state, "kline") {
+		return
+	}
+
+	result, mask := sendCommandToServer(server.commandChan, ADD_KLINE, state.nick, banParams)
+	if result == ERR_NOSUCHNICKNAME {
+		state.sendq.send(fmt.Sprintf(":%v 401 %v %v :No such nick/channel\r\n", server.name, state.nick, banParams[0]))
+		return
+	}
+
+	state.sendq.send(fmt.Sprintf(":%v NOTICE %v :Added K-line for [%v]\r\n", server.name, state.nick, mask))
+}
+
+// UNKLINE <mask>
+func handleUnkline(server ServerInfo, state *connectionState, params []string) {
+	if !isRegistered(*state) {
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+	if len(params) < 1 {
+		state.sendq.send(errNeedMoreParams(server.name, state.nick, "UNKLINE"))
+		return
+	}
+	if !checkPrivilege(server, state, "kline") {
+		return
+	}
+
+	result, _ := sendCommandToServer(server.commandChan, REMOVE_KLINE, state.nick, params[:1])
+	if result == ERR_NOSUCHBAN {
+		state.sendq.send(fmt.Sprintf(":%v NOTICE %v :No K-line for [%v]\r\n", server.name, state.nick, params[0]))
+		return
+	}
+
+	state.sendq.send(fmt.Sprintf(":%v NOTICE %v :Removed K-line for [%v]\r\n", server.name, state.nick, params[0]))
+}
+
+// Bans an IP or CIDR range.
+// DLINE [<minutes>] <ip> [:<reason>]
+func handleDline(server ServerInfo, state *connectionState, params []string) {
+	if !isRegistered(*state) {
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+	banParams, valid := parseBanParams(params)
+	if !valid {
+		state.sendq.send(errNeedMoreParams(server.name, state.nick, "DLINE"))
+		return
+	}
+	if !checkPrivilege(server, state, "dline") {
+		return
+	}
+	if !isValidIPMask(banParams[0]) {
+		state.sendq.send(fmt.Sprintf(":%v NOTICE %v :Invalid D-line [%v]\r\n", server.name, state.nick, banParams[0]))
+		return
+	}
+
+	_, mask := sendCommandToServer(server.commandChan, ADD_DLINE, state.nick, banParams)
+	state.sendq.send(fmt.Sprintf(":%v NOTICE %v :Added D-line for [%v]\r\n", server.name, state.nick, mask))
+}
+
+// UNDLINE <ip>
+func handleUndline(server ServerInfo, state *connectionState, params []string) {
+	if !isRegistered(*state) {
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+	if len(params) < 1 {
+		state.sendq.send(errNeedMoreParams(server.name, state.nick, "UNDLINE"))
+		return
+	}
+	if !checkPrivilege(server, state, "dline") {
+		return
+	}
+
+	result, _ := sendCommandToServer(server.commandChan, REMOVE_DLINE, state.nick, params[:1])
+	if result == ERR_NOSUCHBAN {
+		state.sendq.send(fmt.Sprintf(":%v NOTICE %v :No D-line for [%v]\r\n", server.name, state.nick, params[0]))
+		return
+	}
+
+	state.sendq.send(fmt.Sprintf(":%v NOTICE %v :Removed D-line for [%v]\r\n", server.name, state.nick, params[0]))
+}
+
+// Reloads the config file
+func handleRehash(server ServerInfo, state *connectionState, params []string) {
+	if !isRegistered(*state) {
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+	if !checkPrivilege(server, state, "rehash") {
+		return
+	}
+
+	state.sendq.send(fmt.Sprintf(":%v 382 %v %v :Rehashing\r\n", server.name, state.nick, server.configPath))
+	changes, err := rehash(server)
+	if err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			state.sendq.send(fmt.Sprintf(":%v NOTICE %v :Rehash failed: %v\r\n", server.name, state.nick, line))
+		}
+		return
+	}
+
+	if len(changes) == 0 {
+		changes = []string{"No changes"}
+	}
+	for _, change := range changes {
+		state.sendq.send(fmt.Sprintf(":%v NOTICE %v :Rehash: %v\r\n", server.name, state.nick, change))
+	}
+}
+
+// Who runs the server, ADMIN [<server>]
+func handleAdmin(server ServerInfo, state *connectionState, params []string) {
+	if !isRegistered(*state) {
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+	if !isThisServer(server, state, params) {
+		return
+	}
+
+	result, admin := sendCommandToServer(server.commandChan, GET_ADMIN, state.nick, []string{})
+	if result == ERR_NOADMININFO {
+		state.sendq.send(fmt.Sprintf(":%v 423 %v %v :No administrative info available\r\n", server.name, state.nick, server.name))
+		return
+	}
+
+	info := strings.Split(admin, "\n")
+	state.sendq.send(fmt.Sprintf(":%v 256 %v %v :Administrative info\r\n", server.name, state.nick, server.name) +
+		fmt.Sprintf(":%v 257 %v :%v\r\n", server.name, state.nick, info[0]) +
+		fmt.Sprintf(":%v 258 %v :%v\r\n", server.name, state.nick, info[1]) +
+		fmt.Sprintf(":%v 259 %v :%v\r\n", server.name, state.nick, info[2]))
+}
+
+// Describes the server software, INFO [<server>]
+func handleInfo(server ServerInfo, state *connectionState, params []string) {
+	if !isRegistered(*state) {
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+	if !isThisServer(server, state, params) {
+		return
+	}
+
+	info := []string{
+		fmt.Sprintf("IRC server version %v", version),
+		fmt.Sprintf("Built with %v", runtime.Version()),
+	}
+
+	replies := ""
+	for _, line := range info {
+		replies += fmt.Sprintf(":%v 371 %v :%v\r\n", server.name, state.nick, line)
+	}
+	state.sendq.send(replies + fmt.Sprintf(":%v 374 %v :End of INFO list\r\n", server.name, state.nick))
+}
+
+// VERSION [<server>], also sends the ISUPPORT tokens again
+func handleVersion(server ServerInfo, state *connectionState, params []string) {
+	if !isRegistered(*state) {
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+	if !isThisServer(server, state, params) {
+		return
+	}
+
+	_, isupport := sendCommandToServer(server.commandChan, ISUPPORT, state.nick, []string{})
+	state.sendq.send(fmt.Sprintf(":%v 351 %v %v %v :\r\n", server.name, state.nick, version, server.name) +
+		rplIsupport(server.name, state.nick, isupport))
+}
+
+// The server's local time, TIME [<server>]
+func handleTime(server ServerInfo, state *connectionState, params []string) {
+	if !isRegistered(*state) {
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+	if !isThisServer(server, state, params) {
+		return
+	}
+
+	state.sendq.send(fmt.Sprintf(":%v 391 %v %v :%v\r\n", server.name, state.nick, server.name, time.Now().Format(time.RFC1123)))
+}
+
+// Reports on the server, STATS <letter>.
+// Anyone can see the uptime and command usage, the rest needs the stats privilege.
+func handleStats(server ServerInfo, state *connectionState, params []string) {
+	if !isRegistered(*state) {
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+	if len(params) < 1 {
+		state.sendq.send(errNeedMoreParams(server.name, state.nick, "STATS"))
+		return
+	}
+	if params[0] != "u" && params[0] != "m" && !checkPrivilege(server, state, "stats") {
+		return
+	}
+
+	_, replies := sendCommandToServer(server.commandChan, STATS, state.nick, params[:1])
+	state.sendq.send(replies + fmt.Sprintf(":%v 219 %v %v :End of STATS report\r\n", server.name, state.nick, params[0]))
+}
+
+// Shuts the server down
+func handleDie(server ServerInfo, state *connectionState, params []string) {
+	if !isRegistered(*state) {
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+	if !checkPrivilege(server, state, "die") {
+		return
+	}
+
+	shutdownServer(server, shutdownReason("DIE", state.nick, params), false)
+}
+
+// Shuts the server down, then starts it again
+func handleRestart(server ServerInfo, state *connectionState, params []string) {
+	if !isRegistered(*state) {
+		state.sendq.send(errUnregistered(server.name, state.nick))
+		return
+	}
+	if !checkPrivilege(server, state, "restart") {
+		return
+	}
+
+	shutdownServer(server, shutdownReason("RESTART", state.nick, params), true)
 }
 
 // func handle(server ServerInfo, state *connectionState, params []string) {
 // if !isRegistered(*state) {
-// 		state.messageChan <- errUnregistered(server.name, state.nick)
+// 		state.sendq.send(errUnregistered(server.name, state.nick))
 // 		return
 // 	}
 // }
 
 // utility functions
 func isRegistered(state connectionState) bool {
-	return len(state.nick) > 0 && len(state.user) > 0
+	return state.phase == phaseRegistered
+}
+
+// Commands which take an optional server target only know about this server, as there is no linking.
+// Sends ERR_NOSUCHSERVER for any other target.
+func isThisServer(server ServerInfo, state *connectionState, params []string) bool {
+	if len(params) == 0 || matchMask(params[0], server.name, foldAscii) {
+		return true
+	}
+
+	state.sendq.send(fmt.Sprintf(":%v 402 %v %v :No such server\r\n", server.name, state.nick, params[0]))
+	return false
+}
+
+// Sends ERR_NOPRIVILEGES unless the user is an operator with the privilege
+func checkPrivilege(server ServerInfo, state *connectionState, privilege string) bool {
+	result, _ := sendCommandToServer(server.commandChan, HAS_PRIVILEGE, state.nick, []string{privilege})
+	if result != OK {
+		state.sendq.send(fmt.Sprintf(":%v 481 %v :Permission Denied- You're not an IRC operator\r\n", server.name, state.nick))
+		return false
+	}
+
+	return true
+}
+
+// Sends an ERROR and closes the connection, telling everyone who shares a channel with the user why they left
+func closeConnection(server ServerInfo, state *connectionState, reason string) {
+	if isRegistered(*state) {
+		sendCommandToServer(server.commandChan, QUIT, state.nick, []string{reason})
+	}
+	state.sendq.send(fmt.Sprintf(":%v ERROR :Closing Link: %v %v\r\n", server.name, state.host, reason))
+	state.phase = phaseClosed
+	requestQuit(state.quit)
+}
+
+// A line read from the connection, or the error which ended reading
+type readResult struct {
+	line string
+	err  error
+}
+
+// Sent by readLines when a client sends more than maxLineLength bytes without a newline
+var errLineTooLong = errors.New("line too long")
+
+// Sends each line read from connection to lines, until reading fails or done is closed.
+// Lines are limited to maxLineLength, so a client can't make the server buffer an endless line.
+func readLines(connection net.Conn, lines chan<- readResult, done <-chan bool) {
+	reader := bufio.NewReaderSize(connection, maxLineLength)
+	for {
+		// Should split on "\r\n"
+		// See https://pkg.go.dev/bufio#Scanner & implementation of SplitLine
+		// Could not get it to correctly handle EOF.
+		slice, err := reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			err = errLineTooLong
+		}
+		// The slice is only valid until the next read
+		line := string(slice)
+		select {
+		case lines <- readResult{line, err}:
+		case <-done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Opers and connections in a class with FloodExempt set aren't held back by flood control
+func isFloodExempt(server ServerInfo, state *connectionState) bool {
+	if state.class.FloodExempt {
+		return true
+	}
+	if !isRegistered(*state) {
+		return false
+	}
+	_, modes := sendCommandToServer(server.commandChan, GET_USER_MODES, state.nick, []string{})
+	return strings.Contains(modes, "o")
+}
+
+// Random, so a client can't answer a PING before it is sent
+func newPingToken() string {
+	token := make([]byte, 4)
+	rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+// Closes the connection once queued messages are sent.
+// Never blocks, so it is safe to call more than once.
+func requestQuit(quit chan<- bool) {
+	select {
+	case quit <- true:
+	default:
+	}
+}
+
+// Converts "[<minutes>] <mask> [<reason>]" to the mask, minutes and reason
+func parseBanParams(params []string) ([]string, bool) {
+	minutes := "0"
+	if len(params) > 1 {
+		_, err := strconv.Atoi(params[0])
+		if err == nil {
+			minutes = params[0]
+			params = params[1:]
+		}
+	}
+	if len(params) < 1 || strings.HasPrefix(minutes, "-") {
+		return nil, false
+	}
+
+	reason := "No reason given"
+	if len(params) > 1 {
+		reason = params[1]
+	}
+
+	return []string{params[0], minutes, reason}, true
+}
+
+// The address of the client as shown in prefixes, without the port.
+// IPv6 addresses starting with ':' get a '0' in front, as a ':' would start a new parameter.
+func formatHost(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		host := addr.IP.String()
+		if strings.HasPrefix(host, ":") {
+			return "0" + host
+		}
+		return host
+	case *net.UnixAddr:
+		return "localhost"
+	default:
+		return addr.String()
+	}
+}
+
+// Returns the address the connection came from, or an empty string if it is not over IP
+func remoteIP(connection net.Conn) string {
+	host, _, err := net.SplitHostPort(connection.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+
+	return host
+}
+
+// Closes the connection if its IP is D-lined, before any other handling
+func rejectIfBanned(server ServerInfo, connection net.Conn) bool {
+	result, reason := sendCommandToServer(server.commandChan, CHECK_DLINE, "", []string{remoteIP(connection)})
+	if result != ERR_YOUREBANNEDCREEP {
+		return false
+	}
+
+	// On TLS listeners the write runs the handshake, so don't let the client hold it open
+	connection.SetDeadline(time.Now().Add(handshakeTimeout))
+	fmt.Fprintf(connection, "ERROR :Closing Link: %v D-lined (%v)\r\n", remoteIP(connection), reason)
+	connection.Close()
+	return true
+}
+
+// Such as "DIE by nick: reason", the reason is optional
+func shutdownReason(command string, nick string, params []string) string {
+	reason := fmt.Sprintf("%v by %v", command, nick)
+	if len(params) > 0 {
+		reason += ": " + params[0]
+	}
+
+	return reason
+}
+
+// Splits text into pieces of at most width bytes, breaking at spaces where possible
+func wrapLine(line string, width int) []string {
+	pieces := []string{}
+	for len(line) > width {
+		cut := strings.LastIndex(line[:width+1], " ")
+		if cut > 0 {
+			pieces = append(pieces, line[:cut])
+			line = line[cut+1:]
+			continue
+		}
+
+		// No space to break at, so split the word without splitting a character
+		cut = width
+		for cut > 1 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		pieces = append(pieces, line[:cut])
+		line = line[cut:]
+	}
+
+	return append(pieces, line)
+}
+
+func enabledCapabilities(state connectionState) []string {
+	enabled := []string{}
+	for c, on := range state.capabilities {
+		if on {
+			enabled = append(enabled, c)
+		}
+	}
+
+	return enabled
 }
 
 func tokenize(message string) (command string, params []string) {
@@ -450,8 +1370,26 @@ func (e *nickNameInUseError) Error() string {
 	return fmt.Sprintf(":%v 433 %v %v :Nickname is already in use\r\n", e.server, e.client, e.nick)
 }
 
+type erroneusNicknameError struct {
+	server string
+	client string
+	nick   string
+}
+
+func (e *erroneusNicknameError) Error() string {
+	return fmt.Sprintf(":%v 432 %v %v :Erroneous nickname\r\n", e.server, e.client, e.nick)
+}
+
 // Will clear state.nick if nickname already in use
 func tryRegister(server ServerInfo, state *connectionState, nick string) []string {
+	result, reason := sendCommandToServer(server.commandChan, CHECK_KLINE, nick, []string{state.user, state.host, state.ip})
+	if result == ERR_YOUREBANNEDCREEP {
+		// Sent here rather than returned so they are queued before the connection closes
+		state.sendq.send(fmt.Sprintf(":%v 465 * :You are banned from this server- %v\r\n", server.name, reason))
+		closeConnection(server, state, fmt.Sprintf("K-lined (%v)", reason))
+		return []string{}
+	}
+
 	err := trySetNick(server, "*", nick)
 	if err != nil {
 		state.nick = ""
@@ -459,19 +1397,27 @@ func tryRegister(server ServerInfo, state *connectionState, nick string) []strin
 	}
 
 	state.nick = nick
-
-	server.registrationChan <- Registration{state.nick, state.user, state.host, state.realName, state.messageChan}
-	return rplWelcome(server.name, state.nick, state.user, state.host)
+	state.phase = phaseRegistered
+
+	server.registrationChan <- Registration{state.id, state.nick, state.user, state.host, state.ip, state.secure, state.certfp, state.account, state.realName, enabledCapabilities(*state), state.sendq, state.quit}
+	// The host may have been cloaked
+	_, host := sendCommandToServer(server.commandChan, GET_HOST_NAME, state.nick, []string{state.nick})
+	_, isupport := sendCommandToServer(server.commandChan, ISUPPORT, state.nick, []string{})
+	response := rplWelcome(server.name, state.nick, state.user, host, isupport)
+	response = append(response, rplLusers(server, state.nick)...)
+	return append(response, rplMotd(server, state.nick)...)
 }
 
 func trySetNick(server ServerInfo, client, nick string) error {
 	// Check with server
-	result, _ := sendCommandToServer(server.commandChan, NICK, nick, []string{})
+	result, _ := sendCommandToServer(server.commandChan, NICK, nick, []string{client})
 	switch result {
 	case OK:
 		return nil
 	case ERR_NICKNAMEINUSE:
 		return &nickNameInUseError{server.name, client, nick}
+	case ERR_ERRONEUSNICKNAME:
+		return &erroneusNicknameError{server.name, client, nick}
 	default:
 		// FIXME: This should still be an error case
 		panic(0)
@@ -485,20 +1431,56 @@ func sendCommandToServer(channel chan<- Command, command int, nick string, param
 	return r.result, r.params
 }
 
-func rplWelcome(server string, nick string, user string, host string) []string {
+// Disconnects everyone, then stops the server.
+// Only the first request has any effect.
+func shutdownServer(server ServerInfo, reason string, restart bool) {
+	select {
+	case server.shutdownChan <- Shutdown{reason, restart}:
+	case <-server.stopping:
+		// Already shutting down, and the server may have stopped listening
+	}
+}
+
+func rplWelcome(server string, nick string, user string, host string, isupport string) []string {
 	// FIXME:
-	const version = "0.0"
 	const creationDate = "01/01/1970"
 	const userModes = "0"
 	const channelModes = "0"
 	const rplWelcomeFormat = ":%v 001 %v :Welcome to the Internet Relay Network %v!%v@%v\r\n"
-	// TODO! Add MOTD and LUSER responses
 	return []string{
 		fmt.Sprintf(rplWelcomeFormat, server, nick, nick, user, host),
 		fmt.Sprintf(":%v 002 %v :Your host is %v, running version %v\r\n", server, nick, server, version),
 		fmt.Sprintf(":%v 003 %v :This server was created %v\r\n", server, nick, creationDate),
 		fmt.Sprintf(":%v 004 %v :%v %v %v %v\r\n", server, nick, server, version, userModes, channelModes),
+		rplIsupport(server, nick, isupport),
+	}
+}
+
+func rplLusers(server ServerInfo, nick string) []string {
+	_, replies := sendCommandToServer(server.commandChan, LUSERS, nick, []string{})
+	return []string{replies}
+}
+
+// Long lines are wrapped so each reply fits in the 512 byte line limit
+func rplMotd(server ServerInfo, nick string) []string {
+	result, motd := sendCommandToServer(server.commandChan, GET_MOTD, nick, []string{})
+	if result == ERR_NOMOTD {
+		return []string{fmt.Sprintf(":%v 422 %v :MOTD File is missing\r\n", server.name, nick)}
 	}
+
+	prefix := fmt.Sprintf(":%v 372 %v :- ", server.name, nick)
+	replies := []string{fmt.Sprintf(":%v 375 %v :- %v Message of the day - \r\n", server.name, nick, server.name)}
+	for _, line := range strings.Split(motd, "\n") {
+		for _, piece := range wrapLine(line, maxLineLength-len(prefix)-len("\r\n")) {
+			replies = append(replies, prefix+piece+"\r\n")
+		}
+	}
+
+	return append(replies, fmt.Sprintf(":%v 376 %v :End of MOTD command\r\n", server.name, nick))
+}
+
+func rplIsupport(server string, nick string, isupport string) string {
+	return fmt.Sprintf(":%v 005 %v %v :are supported by this server\r\n", server, nick, isupport)
 }
 
 func errNeedMoreParams(server string, nick string, command string) string {
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// The DNS lookups needed to find a client's hostname.
+// Satisfied by *net.Resolver, tests use a fake.
+type hostResolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// How long to wait for DNS before using the IP as the host
+const hostnameTimeout = 5 * time.Second
+
+// Replaces the client's IP with their hostname if it can be confirmed, telling them how it went
+func resolveHost(server ServerInfo, state *connectionState) {
+	var notice = func(message string) {
+		state.sendq.send(fmt.Sprintf(":%v NOTICE * :*** %v\r\n", server.name, message))
+	}
+	notice("Looking up your hostname...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), hostnameTimeout)
+	defer cancel()
+	name, found := lookupHostname(ctx, server.resolver, state.ip)
+	if !found {
+		notice("Couldn't look up your hostname")
+		return
+	}
+
+	state.host = name
+	notice("Found your hostname")
+}
+
+// Longer names can't be used in a prefix, see HOSTLEN in other servers
+const maxHostnameLength = 63
+
+// Forward-confirmed reverse DNS: ip's PTR record is only used if that name resolves back to ip.
+// Returns false if there is no such name, or the lookups fail or time out.
+func lookupHostname(ctx context.Context, resolver hostResolver, ip string) (string, bool) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", false
+	}
+
+	names, err := resolver.LookupAddr(ctx, ip)
+	if err != nil {
+		return "", false
+	}
+
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		if !isValidHostname(name) {
+			continue
+		}
+
+		addrs, err := resolver.LookupHost(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if addr.Equal(net.ParseIP(a)) {
+				return name, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// Only letters, digits, '-' and '.', so the name can't be mistaken for an IP or break a prefix
+func isValidHostname(name string) bool {
+	if len(name) == 0 || len(name) > maxHostnameLength || net.ParseIP(name) != nil {
+		return false
+	}
+	if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "-") || strings.Contains(name, "..") {
+		return false
+	}
+
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"time"
+)
+
+// How many messages each command counts as for flood control, 1 if not listed.
+// Commands which make the server do more work, or are useful for probing, cost more.
+var commandPenalties = map[string]int{
+	// Answering a PING uses none of the burst
+	"PONG":    0,
+	"NICK":    2,
+	"JOIN":    2,
+	"WHOIS":   2,
+	"WHO":     2,
+	"NAMES":   2,
+	"LIST":    3,
+	"AWAY":    2,
+	"SETNAME": 2,
+	"OPER":    3,
+	"MOTD":    2,
+	"LUSERS":  2,
+	"STATS":   2,
+	"INFO":    2,
+}
+
+func commandPenalty(command string) int {
+	penalty, listed := commandPenalties[command]
+	if !listed {
+		return 1
+	}
+	return penalty
+}
+
+// A token bucket which delays messages from clients sending faster than their class allows.
+// The bucket holds FloodBurst messages and refills by one every FloodInterval.
+// Rather than counting tokens, penaltyTime runs ahead of the current time by the penalty of
+// the messages handled, and messages wait while it is more than a full bucket ahead.
+type floodControl struct {
+	class ClassConfig
+	// Read from the client but not handled yet
+	queue       []string
+	penaltyTime time.Time
+}
+
+func newFloodControl(class ClassConfig) *floodControl {
+	return &floodControl{class: class}
+}
+
+// Queues a message, returning false if the client has sent more than FloodLimit messages
+// which are still waiting
+func (f *floodControl) push(message string) bool {
+	f.queue = append(f.queue, message)
+	return len(f.queue) <= f.class.FloodLimit
+}
+
+// Returns when the next queued message can be handled, or the zero time if there are none
+func (f *floodControl) readyAt(now time.Time) time.Time {
+	if len(f.queue) == 0 {
+		return time.Time{}
+	}
+
+	command, _ := tokenize(f.queue[0])
+	penaltyTime := f.penaltyTime
+	if penaltyTime.Before(now) {
+		penaltyTime = now
+	}
+	penalty := time.Duration(commandPenalty(command)-f.class.FloodBurst) * f.class.FloodInterval
+	return penaltyTime.Add(penalty)
+}
+
+// Removes the next queued message, adding its penalty unless the client is exempt
+func (f *floodControl) pop(now time.Time, exempt bool) string {
+	message := f.queue[0]
+	f.queue = f.queue[1:]
+	if exempt {
+		return message
+	}
+
+	command, _ := tokenize(message)
+	if f.penaltyTime.Before(now) {
+		f.penaltyTime = now
+	}
+	f.penaltyTime = f.penaltyTime.Add(time.Duration(commandPenalty(command)) * f.class.FloodInterval)
+	return message
+}
@@ -2,8 +2,24 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"math/big"
 	"net"
+	"os"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -31,6 +47,17 @@ func discardResponse(reader *bufio.ReadWriter, min_number uint) {
 	reader.Reader.Discard(reader.Reader.Buffered())
 }
 
+// Reads up to the end of the burst of replies sent on registration
+func discardRegistration(reader *bufio.ReadWriter) {
+	for {
+		r, err := reader.ReadString('\n')
+		// The MOTD comes last, ending with RPL_ENDOFMOTD or ERR_NOMOTD
+		if err != nil || strings.Contains(r, " 376 ") || strings.Contains(r, " 422 ") {
+			return
+		}
+	}
+}
+
 func TestAssert(t *testing.T) {
 	assert.Equal(t, 1+1, 2)
 }
@@ -64,6 +91,15 @@ func TestRegisterUserRespondsWithRpl(t *testing.T) {
 		":bar.example.com 002 nick :Your host is bar.example.com, running version 0.0\r\n",
 		":bar.example.com 003 nick :This server was created 01/01/1970\r\n",
 		":bar.example.com 004 nick :bar.example.com 0.0 0 0\r\n",
+		":bar.example.com 005 nick CASEMAPPING=rfc1459 MONITOR=100 NICKLEN=30 :are supported by this server\r\n",
+		":bar.example.com 251 nick :There are 1 users and 0 invisible on 1 servers\r\n",
+		":bar.example.com 252 nick 0 :operator(s) online\r\n",
+		":bar.example.com 253 nick 0 :unknown connection(s)\r\n",
+		":bar.example.com 254 nick 0 :channels formed\r\n",
+		":bar.example.com 255 nick :I have 1 clients and 0 servers\r\n",
+		":bar.example.com 265 nick 1 1 :Current local users 1, max 1\r\n",
+		":bar.example.com 266 nick 1 1 :Current global users 1, max 1\r\n",
+		":bar.example.com 422 nick :MOTD File is missing\r\n",
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -71,16 +107,13 @@ func TestRegisterUserRespondsWithRpl(t *testing.T) {
 			server := MakeServer("bar.example.com")
 			newIrcConnection(server, serverConn)
 
+			// Partial registration is accepted silently
 			writeAndFlush(client, tt.first)
-			r, _ := client.ReadString('\n')
-			assert.Equal(t, "\r\n", r)
-			assert.Zero(t, client.Reader.Buffered())
-
 			writeAndFlush(client, tt.second)
 
 			response := []string{}
 			for _ = range len(expected) {
-				r, _ = client.ReadString('\n')
+				r, _ := client.ReadString('\n')
 				response = append(response, r)
 			}
 
@@ -97,8 +130,11 @@ func TestNickErrors(t *testing.T) {
 		expected string
 	}{
 		{"ERR_NONICKNAMEGIVEN", "NICK\r\n", ":bar.example.com 431 * :No nickname given\r\n"},
-		// {"ERR_ERRONEUSNICKNAME", "NICK\r\n", ":bar.example.com 432 :<nick> : Erroneus nickname\r\n"},
+		{"ERR_ERRONEUSNICKNAME", "NICK #guest\r\n", ":bar.example.com 432 * #guest :Erroneous nickname\r\n"},
+		{"ERR_ERRONEUSNICKNAME starting with a digit", "NICK 1guest\r\n", ":bar.example.com 432 * 1guest :Erroneous nickname\r\n"},
+		{"ERR_ERRONEUSNICKNAME too long", "NICK abcdefghijklmnopqrstuvwxyzabcde\r\n", ":bar.example.com 432 * abcdefghijklmnopqrstuvwxyzabcde :Erroneous nickname\r\n"},
 		{"ERR_NICKNAMEINUSE", "NICK guest\r\n", ":bar.example.com 433 * guest :Nickname is already in use\r\n"},
+		{"ERR_NICKNAMEINUSE with different case", "NICK GUEST\r\n", ":bar.example.com 433 * GUEST :Nickname is already in use\r\n"},
 		// {"ERR_NICKCOLLISION", "NICK\r\n", ":bar.example.com 436 guest :Nickname collision KILL from <user>@<host>\r\n"},
 		// {"ERR_UNAVAILABLERESOURCE", "NICK\r\n", ":bar.example.com 437 guest :Nick/channel is temporarily unavailable\r\n"},
 		// {"ERR_RESTRICTED", "NICK\r\n", ":bar.example.com 484 :Your connection is restricted!\r\n"},
@@ -112,15 +148,13 @@ func TestNickErrors(t *testing.T) {
 			client, serverConn := makeTestConn()
 			newIrcConnection(server, serverConn)
 			writeAndFlush(client, "NICK guest\r\n")
-			discardResponse(client, 1)
 			writeAndFlush(client, "USER 0 * guest :Joe Blogs\r\n")
-			discardResponse(client, 4)
+			discardRegistration(client)
 
 			// start test
 			client2, serverConn := makeTestConn()
 			newIrcConnection(server, serverConn)
 			writeAndFlush(client2, "USER 0 * guest :Joe Blogs\r\n")
-			discardResponse(client2, 1)
 			writeAndFlush(client2, tt.input)
 			response, _ := client2.ReadString('\n')
 
@@ -148,9 +182,8 @@ func TestUserErrors(t *testing.T) {
 			client, serverConn := makeTestConn()
 			newIrcConnection(server, serverConn)
 			writeAndFlush(client, "NICK guest\r\n")
-			discardResponse(client, 1)
 			writeAndFlush(client, "USER guest 0 * :Joe Bloggs\r\n")
-			discardResponse(client, 4)
+			discardRegistration(client)
 
 			writeAndFlush(client, tt.input)
 			response, _ := client.ReadString('\n')
@@ -189,7 +222,6 @@ func TestCommandsRejectedIfNotRegistered(t *testing.T) {
 			client, serverConn := makeTestConn()
 			newIrcConnection(server, serverConn)
 			writeAndFlush(client, "NICK guest\r\n")
-			discardResponse(client, 1)
 
 			writeAndFlush(client, command)
 			response, _ := client.ReadString('\n')
@@ -207,17 +239,76 @@ func TestNickUpdatesNickName(t *testing.T) {
 	client, serverConn := makeTestConn()
 	newIrcConnection(server, serverConn)
 	writeAndFlush(client, "NICK guest\r\n")
-	discardResponse(client, 1)
 	writeAndFlush(client, "USER guest 0 * :Joe Bloggs\r\n")
-	discardResponse(client, 4)
+	discardRegistration(client)
 
 	writeAndFlush(client, "NICK notguest\r\n")
 	response, _ := client.ReadString('\n')
 
-	assert.Equal(t, ":guest NICK notguest\r\n", response)
+	assert.Equal(t, ":guest!guest@pipe NICK notguest\r\n", response)
 	assert.Zero(t, client.Reader.Buffered())
 }
 
+func TestNickChangePropagatesToChannels(t *testing.T) {
+	server := MakeServer("bar.example.com")
+
+	var newTestConn = func(nick string) (client *bufio.ReadWriter) {
+		client, serverConn := makeTestConn()
+		newIrcConnection(server, serverConn)
+		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+		discardRegistration(client)
+
+		return
+	}
+
+	// Setup
+	guest := newTestConn("guest")
+	writeAndFlush(guest, "JOIN #test1\r\n")
+	discardResponse(guest, 4)
+	writeAndFlush(guest, "JOIN #test2\r\n")
+	discardResponse(guest, 4)
+
+	// Shares both channels
+	peer := newTestConn("peer")
+	writeAndFlush(peer, "JOIN #test1\r\n")
+	discardResponse(peer, 4)
+	discardResponse(guest, 1)
+	writeAndFlush(peer, "JOIN #test2\r\n")
+	discardResponse(peer, 4)
+	discardResponse(guest, 1)
+
+	// Shares no channels
+	other := newTestConn("other")
+
+	writeAndFlush(guest, "NICK renamed\r\n")
+	expected := ":guest!guest@pipe NICK renamed\r\n"
+	r, _ := guest.ReadString('\n')
+	assert.Equal(t, expected, r)
+	assert.Zero(t, guest.Reader.Buffered())
+
+	// Only sent once
+	r, _ = peer.ReadString('\n')
+	assert.Equal(t, expected, r)
+	writeAndFlush(peer, "NAMES #test1\r\n")
+	r, _ = peer.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 353 peer = #test1 :+peer +renamed\r\n", r)
+	discardResponse(peer, 1)
+	assert.Zero(t, peer.Reader.Buffered())
+
+	// Old nick has been released
+	writeAndFlush(other, "NICK guest\r\n")
+	r, _ = other.ReadString('\n')
+	assert.Equal(t, ":other!other@pipe NICK guest\r\n", r)
+	assert.Zero(t, other.Reader.Buffered())
+
+	// New nick can be looked up
+	writeAndFlush(other, "WHOIS renamed\r\n")
+	r, _ = other.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 311 guest renamed renamed pipe :Joe Bloggs\r\n", r)
+	discardResponse(other, 2)
+}
+
 func TestQuitEndsConnection(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -237,9 +328,8 @@ func TestQuitEndsConnection(t *testing.T) {
 			client, serverConn := makeTestConn()
 			newIrcConnection(server, serverConn)
 			writeAndFlush(client, "NICK guest\r\n")
-			discardResponse(client, 1)
 			writeAndFlush(client, "USER guest 0 * :Joe Bloggs\r\n")
-			discardResponse(client, 4)
+			discardRegistration(client)
 
 			writeAndFlush(client, tt.input)
 			response, _ := client.ReadString('\n')
@@ -251,10 +341,11 @@ func TestQuitEndsConnection(t *testing.T) {
 			client2, serverConn2 := makeTestConn()
 			newIrcConnection(server, serverConn2)
 			writeAndFlush(client2, "NICK guest\r\n")
+			writeAndFlush(client2, "USER guest 0 * :Joe Bloggs\r\n")
 			response, _ = client2.ReadString('\n')
 
-			assert.Equal(t, "\r\n", response)
-			assert.Zero(t, client2.Reader.Buffered())
+			assert.Equal(t, ":bar.example.com 001 guest :Welcome to the Internet Relay Network guest!guest@pipe\r\n", response)
+			discardRegistration(client2)
 
 			//test that the connection has been shut
 			_, err := serverConn.Read([]byte{})
@@ -282,9 +373,8 @@ func TestSendingDMs(t *testing.T) {
 				client, serverConn := makeTestConn()
 				newIrcConnection(server, serverConn)
 				writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
-				discardResponse(client, 1)
 				writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
-				discardResponse(client, 4)
+				discardRegistration(client)
 
 				return
 			}
@@ -318,9 +408,8 @@ func TestSendingToChannels(t *testing.T) {
 				client, serverConn := makeTestConn()
 				newIrcConnection(server, serverConn)
 				writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
-				discardResponse(client, 1)
 				writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
-				discardResponse(client, 4)
+				discardRegistration(client)
 				writeAndFlush(client, "JOIN #test\r\n")
 				discardResponse(client, 4)
 
@@ -369,9 +458,8 @@ func TestMessageSendingErrors(t *testing.T) {
 				client, serverConn := makeTestConn()
 				newIrcConnection(server, serverConn)
 				writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
-				discardResponse(client, 1)
 				writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
-				discardResponse(client, 4)
+				discardRegistration(client)
 
 				return
 			}
@@ -405,9 +493,8 @@ func TestPingingServer(t *testing.T) {
 			client, serverConn := makeTestConn()
 			newIrcConnection(server, serverConn)
 			writeAndFlush(client, "NICK guest\r\n")
-			discardResponse(client, 1)
 			writeAndFlush(client, "USER guest 0 * :Joe Bloggs\r\n")
-			discardResponse(client, 4)
+			discardRegistration(client)
 
 			writeAndFlush(client, tt.input)
 			response, _ := client.ReadString('\n')
@@ -425,9 +512,8 @@ func TestPongingServerDoesNotRespond(t *testing.T) {
 	client, serverConn := makeTestConn()
 	newIrcConnection(server, serverConn)
 	writeAndFlush(client, "NICK guest\r\n")
-	discardResponse(client, 1)
 	writeAndFlush(client, "USER guest 0 * :Joe Bloggs\r\n")
-	discardResponse(client, 4)
+	discardRegistration(client)
 
 	writeAndFlush(client, "PONG :bar.example.com\r\n")
 	response, _ := client.ReadString('\n')
@@ -443,48 +529,65 @@ func TestMotdErrors(t *testing.T) {
 	client, serverConn := makeTestConn()
 	newIrcConnection(server, serverConn)
 	writeAndFlush(client, "NICK guest\r\n")
-	discardResponse(client, 1)
 	writeAndFlush(client, "USER guest 0 * :Joe Bloggs\r\n")
-	discardResponse(client, 4)
+	discardRegistration(client)
 
 	writeAndFlush(client, "MOTD\r\n")
 	response, _ := client.ReadString('\n')
 
-	assert.Equal(t, ":bar.example.com 422 guest :MOTD not implemented\r\n", response)
+	assert.Equal(t, ":bar.example.com 422 guest :MOTD File is missing\r\n", response)
 	assert.Zero(t, client.Reader.Buffered())
 }
 
 func TestLusers(t *testing.T) {
 	input := "LUSERS\r\n"
 	expected := []string{
-		":bar.example.com 251 sender :There are 2 users and 0 invisible on 0 servers\r\n",
-		":bar.example.com 252 sender 0 :operator(s) online\r\n",
+		":bar.example.com 251 sender :There are 1 users and 1 invisible on 1 servers\r\n",
+		":bar.example.com 252 sender 1 :operator(s) online\r\n",
 		":bar.example.com 253 sender 1 :unknown connection(s)\r\n",
-		":bar.example.com 254 sender 0 :channels formed\r\n",
-		":bar.example.com 255 sender :I have 3 clients and 0 servers\r\n",
+		":bar.example.com 254 sender 1 :channels formed\r\n",
+		":bar.example.com 255 sender :I have 2 clients and 0 servers\r\n",
+		":bar.example.com 265 sender 2 3 :Current local users 2, max 3\r\n",
+		":bar.example.com 266 sender 2 3 :Current global users 2, max 3\r\n",
 	}
 
-	server := MakeServer("bar.example.com")
+	server := newTestOperServer([]string{})
 
 	var newTestConn = func(nick string) (client *bufio.ReadWriter) {
 		client, serverConn := makeTestConn()
 		newIrcConnection(server, serverConn)
 		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
-		discardResponse(client, 1)
 		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
-		discardResponse(client, 4)
+		discardRegistration(client)
 
 		return
 	}
 
 	sender := newTestConn("sender")
-	_ = newTestConn("guest1")
+	writeAndFlush(sender, "MODE sender +i\r\n")
+	discardResponse(sender, 1)
+	writeAndFlush(sender, "OPER admin hunter2\r\n")
+	discardResponse(sender, 2)
+
+	guest1 := newTestConn("guest1")
+	writeAndFlush(guest1, "JOIN #test\r\n")
+	discardResponse(guest1, 4)
+
+	// Counts towards the peak after leaving
+	guest3 := newTestConn("guest3")
+	writeAndFlush(guest3, "QUIT\r\n")
+	discardResponse(guest3, 1)
 
 	// Incomplete registration
 	guest2, serverConn := makeTestConn()
 	newIrcConnection(server, serverConn)
 	writeAndFlush(guest2, "NICK guest2\r\n")
-	discardResponse(guest2, 1)
+
+	// Wait for guest3's connection to close
+	assert.Eventually(t, func() bool {
+		_, lusers := sendCommandToServer(server.commandChan, LUSERS, "sender", []string{})
+		return strings.Contains(lusers, " 253 sender 1 ")
+	}, time.Second, time.Millisecond)
 
 	writeAndFlush(sender, input)
 	response := []string{}
@@ -512,9 +615,8 @@ func TestWhois(t *testing.T) {
 		client, serverConn := makeTestConn()
 		newIrcConnection(server, serverConn)
 		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
-		discardResponse(client, 1)
 		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
-		discardResponse(client, 4)
+		discardRegistration(client)
 
 		return
 	}
@@ -551,9 +653,8 @@ func TestWhoisErrors(t *testing.T) {
 				client, serverConn := makeTestConn()
 				newIrcConnection(server, serverConn)
 				writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
-				discardResponse(client, 1)
 				writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
-				discardResponse(client, 4)
+				discardRegistration(client)
 
 				return
 			}
@@ -578,9 +679,8 @@ func TestJoin(t *testing.T) {
 		client, serverConn := makeTestConn()
 		newIrcConnection(server, serverConn)
 		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
-		discardResponse(client, 1)
 		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
-		discardResponse(client, 4)
+		discardRegistration(client)
 
 		return
 	}
@@ -644,9 +744,8 @@ func TestJoinErrors(t *testing.T) {
 				client, serverConn := makeTestConn()
 				newIrcConnection(server, serverConn)
 				writeAndFlush(client, "NICK guest\r\n")
-				discardResponse(client, 1)
 				writeAndFlush(client, "USER guest 0 * :Joe Bloggs\r\n")
-				discardResponse(client, 4)
+				discardRegistration(client)
 
 				return
 			}
@@ -680,9 +779,8 @@ func TestPart(t *testing.T) {
 				client, serverConn := makeTestConn()
 				newIrcConnection(server, serverConn)
 				writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
-				discardResponse(client, 1)
 				writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
-				discardResponse(client, 4)
+				discardRegistration(client)
 
 				return
 			}
@@ -747,9 +845,8 @@ func TestPartErrors(t *testing.T) {
 				client, serverConn := makeTestConn()
 				newIrcConnection(server, serverConn)
 				writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
-				discardResponse(client, 1)
 				writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
-				discardResponse(client, 4)
+				discardRegistration(client)
 
 				return
 			}
@@ -804,9 +901,8 @@ func TestNames(t *testing.T) {
 				client, serverConn := makeTestConn()
 				newIrcConnection(server, serverConn)
 				writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
-				discardResponse(client, 1)
 				writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
-				discardResponse(client, 4)
+				discardRegistration(client)
 
 				return
 			}
@@ -839,3 +935,2520 @@ func TestNames(t *testing.T) {
 		})
 	}
 }
+
+func TestIson(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"all online", "ISON guest sender\r\n", ":bar.example.com 303 sender :guest sender\r\n"},
+		{"some online", "ISON foo guest bar\r\n", ":bar.example.com 303 sender :guest\r\n"},
+		{"none online", "ISON foo\r\n", ":bar.example.com 303 sender :\r\n"},
+		{"trailing parameter", "ISON :guest foo sender\r\n", ":bar.example.com 303 sender :guest sender\r\n"},
+		{"unregistered nick", "ISON pending\r\n", ":bar.example.com 303 sender :\r\n"},
+		{"ERR_NEEDMOREPARAMS", "ISON\r\n", ":bar.example.com 461 sender ISON :Not enough parameters\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := MakeServer("bar.example.com")
+
+			var newTestConn = func(nick string) (client *bufio.ReadWriter) {
+				client, serverConn := makeTestConn()
+				newIrcConnection(server, serverConn)
+				writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+				writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+				discardRegistration(client)
+
+				return
+			}
+
+			sender := newTestConn("sender")
+			_ = newTestConn("guest")
+
+			// Incomplete registration
+			pending, serverConn := makeTestConn()
+			newIrcConnection(server, serverConn)
+			writeAndFlush(pending, "NICK pending\r\n")
+
+			writeAndFlush(sender, tt.input)
+			response, _ := sender.ReadString('\n')
+
+			assert.Equal(t, tt.expected, response)
+			assert.Zero(t, sender.Reader.Buffered())
+		})
+	}
+}
+
+func TestUserhost(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"single nick", "USERHOST guest\r\n", ":bar.example.com 302 sender :guest=+guest@pipe\r\n"},
+		{"multiple nicks", "USERHOST sender foo guest\r\n", ":bar.example.com 302 sender :sender=+sender@pipe guest=+guest@pipe\r\n"},
+		{"at most five nicks", "USERHOST a b c d e guest\r\n", ":bar.example.com 302 sender :\r\n"},
+		{"ERR_NEEDMOREPARAMS", "USERHOST\r\n", ":bar.example.com 461 sender USERHOST :Not enough parameters\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := MakeServer("bar.example.com")
+
+			var newTestConn = func(nick string) (client *bufio.ReadWriter) {
+				client, serverConn := makeTestConn()
+				newIrcConnection(server, serverConn)
+				writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+				writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+				discardRegistration(client)
+
+				return
+			}
+
+			sender := newTestConn("sender")
+			_ = newTestConn("guest")
+
+			writeAndFlush(sender, tt.input)
+			response, _ := sender.ReadString('\n')
+
+			assert.Equal(t, tt.expected, response)
+			assert.Zero(t, sender.Reader.Buffered())
+		})
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{"add online nick", "MONITOR + guest\r\n", []string{
+			":bar.example.com 730 watcher :guest!guest@pipe\r\n",
+		}},
+		{"add offline nick", "MONITOR + foo\r\n", []string{
+			":bar.example.com 731 watcher :foo\r\n",
+		}},
+		{"add multiple nicks", "MONITOR + guest,foo,bar\r\n", []string{
+			":bar.example.com 730 watcher :guest!guest@pipe\r\n",
+			":bar.example.com 731 watcher :foo,bar\r\n",
+		}},
+		{"list when empty", "MONITOR L\r\n", []string{
+			":bar.example.com 733 watcher :End of MONITOR list\r\n",
+		}},
+		{"ERR_NEEDMOREPARAMS", "MONITOR\r\n", []string{
+			":bar.example.com 461 watcher MONITOR :Not enough parameters\r\n",
+		}},
+		{"ERR_NEEDMOREPARAMS with no targets", "MONITOR +\r\n", []string{
+			":bar.example.com 461 watcher MONITOR :Not enough parameters\r\n",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := MakeServer("bar.example.com")
+
+			var newTestConn = func(nick string) (client *bufio.ReadWriter) {
+				client, serverConn := makeTestConn()
+				newIrcConnection(server, serverConn)
+				writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+				writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+				discardRegistration(client)
+
+				return
+			}
+
+			watcher := newTestConn("watcher")
+			_ = newTestConn("guest")
+
+			writeAndFlush(watcher, tt.input)
+			response := []string{}
+			for _ = range tt.expected {
+				r, _ := watcher.ReadString('\n')
+				response = append(response, r)
+			}
+
+			assert.Equal(t, tt.expected, response)
+			assert.Zero(t, watcher.Reader.Buffered())
+		})
+	}
+}
+
+func TestMonitorListManagement(t *testing.T) {
+	server := MakeServer("bar.example.com")
+
+	watcher, serverConn := makeTestConn()
+	newIrcConnection(server, serverConn)
+	writeAndFlush(watcher, "NICK watcher\r\n")
+	writeAndFlush(watcher, "USER watcher 0 * :Joe Bloggs\r\n")
+	discardRegistration(watcher)
+
+	writeAndFlush(watcher, "MONITOR + c,b,a\r\n")
+	discardResponse(watcher, 1)
+
+	writeAndFlush(watcher, "MONITOR - b\r\n")
+	r, _ := watcher.ReadString('\n')
+	assert.Equal(t, "\r\n", r)
+
+	writeAndFlush(watcher, "MONITOR L\r\n")
+	r, _ = watcher.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 732 watcher :a,c\r\n", r)
+	r, _ = watcher.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 733 watcher :End of MONITOR list\r\n", r)
+
+	writeAndFlush(watcher, "MONITOR S\r\n")
+	r, _ = watcher.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 731 watcher :a,c\r\n", r)
+
+	writeAndFlush(watcher, "MONITOR C\r\n")
+	discardResponse(watcher, 1)
+	writeAndFlush(watcher, "MONITOR L\r\n")
+	r, _ = watcher.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 733 watcher :End of MONITOR list\r\n", r)
+	assert.Zero(t, watcher.Reader.Buffered())
+}
+
+func TestMonitorListFull(t *testing.T) {
+	config := DefaultConfig("bar.example.com")
+	config.MonitorLimit = 2
+	server := MakeServerFromConfig(config)
+
+	watcher, serverConn := makeTestConn()
+	newIrcConnection(server, serverConn)
+	writeAndFlush(watcher, "NICK watcher\r\n")
+	writeAndFlush(watcher, "USER watcher 0 * :Joe Bloggs\r\n")
+
+	// Limit is advertised in ISUPPORT
+	r := ""
+	for !strings.Contains(r, " 005 ") {
+		r, _ = watcher.ReadString('\n')
+	}
+	assert.Equal(t, ":bar.example.com 005 watcher CASEMAPPING=rfc1459 MONITOR=2 NICKLEN=30 :are supported by this server\r\n", r)
+	discardRegistration(watcher)
+
+	writeAndFlush(watcher, "MONITOR + a,b,c,d\r\n")
+	r, _ = watcher.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 734 watcher 2 c,d :Monitor list is full\r\n", r)
+	r, _ = watcher.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 731 watcher :a,b\r\n", r)
+	assert.Zero(t, watcher.Reader.Buffered())
+}
+
+func TestMonitorNotifications(t *testing.T) {
+	server := MakeServer("bar.example.com")
+
+	var newTestConn = func(nick string) (client *bufio.ReadWriter) {
+		client, serverConn := makeTestConn()
+		newIrcConnection(server, serverConn)
+		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+		discardRegistration(client)
+
+		return
+	}
+
+	watcher := newTestConn("watcher")
+	writeAndFlush(watcher, "MONITOR + guest,renamed,leaver\r\n")
+	discardResponse(watcher, 1)
+
+	// Registration
+	guest := newTestConn("guest")
+	r, _ := watcher.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 730 watcher :guest!guest@pipe\r\n", r)
+
+	// Nick change
+	writeAndFlush(guest, "NICK renamed\r\n")
+	discardResponse(guest, 1)
+	r, _ = watcher.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 731 watcher :guest\r\n", r)
+	r, _ = watcher.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 730 watcher :renamed!guest@pipe\r\n", r)
+
+	// Quit
+	leaver := newTestConn("leaver")
+	discardResponse(watcher, 1)
+	writeAndFlush(leaver, "QUIT\r\n")
+	discardResponse(leaver, 1)
+	r, _ = watcher.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 731 watcher :leaver\r\n", r)
+	assert.Zero(t, watcher.Reader.Buffered())
+}
+
+func TestCasemapping(t *testing.T) {
+	server := MakeServer("bar.example.com")
+
+	var newTestConn = func(nick string) (client *bufio.ReadWriter) {
+		client, serverConn := makeTestConn()
+		newIrcConnection(server, serverConn)
+		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+		discardRegistration(client)
+
+		return
+	}
+
+	sender := newTestConn("sender")
+	receiver := newTestConn("Re[ceiver]")
+
+	// rfc1459 treats "[]" as the upper case of "{}"
+	writeAndFlush(sender, "PRIVMSG rE{CEIVER} :Hello\r\n")
+	discardResponse(sender, 1)
+	r, _ := receiver.ReadString('\n')
+	assert.Equal(t, ":sender!sender@pipe PRIVMSG rE{CEIVER} :Hello\r\n", r)
+
+	// Replies use the nick as it was registered
+	writeAndFlush(sender, "ISON re{ceiver}\r\n")
+	r, _ = sender.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 303 sender :Re[ceiver]\r\n", r)
+
+	// Channels are casemapped too, and keep the name they were created with
+	writeAndFlush(sender, "JOIN #Test\r\n")
+	discardResponse(sender, 4)
+	writeAndFlush(receiver, "JOIN #TEST\r\n")
+	r, _ = receiver.ReadString('\n')
+	assert.Equal(t, ":Re[ceiver]!Re[ceiver]@pipe JOIN #Test\r\n", r)
+	discardResponse(receiver, 3)
+	discardResponse(sender, 1)
+
+	writeAndFlush(sender, "NAMES #test\r\n")
+	r, _ = sender.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 353 sender = #Test :+Re[ceiver] +sender\r\n", r)
+	discardResponse(sender, 1)
+
+	// Changing only the case of a nick is allowed
+	writeAndFlush(receiver, "NICK re[ceiver]\r\n")
+	r, _ = receiver.ReadString('\n')
+	assert.Equal(t, ":Re[ceiver]!Re[ceiver]@pipe NICK re[ceiver]\r\n", r)
+	r, _ = sender.ReadString('\n')
+	assert.Equal(t, ":Re[ceiver]!Re[ceiver]@pipe NICK re[ceiver]\r\n", r)
+}
+
+func TestMatchMask(t *testing.T) {
+	tests := []struct {
+		mask     string
+		name     string
+		expected bool
+	}{
+		{"*", "anything", true},
+		{"*", "", true},
+		{"nick!*@*", "nick!user@host", true},
+		{"NICK!*@*", "nick!user@host", true},
+		{"n?ck!*@*", "neck!user@host", true},
+		{"*!*@*.example.com", "nick!user@foo.example.com", true},
+		{"*!*@*.example.com", "nick!user@example.com", false},
+		{"*!user@*", "nick!resu@host", false},
+		{"a*b*c", "aXbXbXc", true},
+		{"a*b*c", "aXbXbX", false},
+		{"{nick}", "[NICK]", true},
+		{"?", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v %v", tt.mask, tt.name), func(t *testing.T) {
+			assert.Equal(t, tt.expected, matchMask(tt.mask, tt.name, foldRfc1459))
+		})
+	}
+}
+
+func TestCapNegotiation(t *testing.T) {
+	server := MakeServer("bar.example.com")
+
+	client, serverConn := makeTestConn()
+	newIrcConnection(server, serverConn)
+
+	writeAndFlush(client, "CAP LS 302\r\n")
+	r, _ := client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com CAP * LS :chghost sasl setname\r\n", r)
+
+	// Registration waits for CAP END
+	writeAndFlush(client, "NICK guest\r\n")
+	writeAndFlush(client, "USER guest 0 * :Joe Bloggs\r\n")
+
+	writeAndFlush(client, "CAP REQ :setname foo\r\n")
+	r, _ = client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com CAP * NAK :setname foo\r\n", r)
+
+	writeAndFlush(client, "CAP REQ :setname chghost\r\n")
+	r, _ = client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com CAP * ACK :setname chghost\r\n", r)
+
+	writeAndFlush(client, "CAP REQ :-chghost\r\n")
+	r, _ = client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com CAP * ACK :-chghost\r\n", r)
+
+	writeAndFlush(client, "CAP LIST\r\n")
+	r, _ = client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com CAP * LIST :setname\r\n", r)
+
+	writeAndFlush(client, "CAP END\r\n")
+	r, _ = client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 001 guest :Welcome to the Internet Relay Network guest!guest@pipe\r\n", r)
+	discardRegistration(client)
+
+	writeAndFlush(client, "CAP FOO\r\n")
+	r, _ = client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 410 guest FOO :Invalid CAP command\r\n", r)
+	assert.Zero(t, client.Reader.Buffered())
+}
+
+func TestSetname(t *testing.T) {
+	server := MakeServer("bar.example.com")
+
+	var newTestConn = func(nick string, caps string) (client *bufio.ReadWriter) {
+		client, serverConn := makeTestConn()
+		newIrcConnection(server, serverConn)
+		writeAndFlush(client, fmt.Sprintf("CAP REQ :%v\r\n", caps))
+		discardResponse(client, 1)
+		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+		writeAndFlush(client, "CAP END\r\n")
+		discardRegistration(client)
+		writeAndFlush(client, "JOIN #test\r\n")
+		discardResponse(client, 4)
+
+		return
+	}
+
+	guest := newTestConn("guest", "setname")
+	withCap := newTestConn("withcap", "setname")
+	discardResponse(guest, 1)
+	withoutCap := newTestConn("withoutcap", "chghost")
+	discardResponse(guest, 1)
+	discardResponse(withCap, 1)
+
+	writeAndFlush(guest, "SETNAME :Jane Doe\r\n")
+	expected := ":guest!guest@pipe SETNAME :Jane Doe\r\n"
+	r, _ := guest.ReadString('\n')
+	assert.Equal(t, expected, r)
+	r, _ = withCap.ReadString('\n')
+	assert.Equal(t, expected, r)
+
+	writeAndFlush(withoutCap, "WHOIS guest\r\n")
+	r, _ = withoutCap.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 311 withoutcap guest guest pipe :Jane Doe\r\n", r)
+	discardResponse(withoutCap, 2)
+	assert.Zero(t, withoutCap.Reader.Buffered())
+
+	writeAndFlush(guest, "SETNAME : \r\n")
+	r, _ = guest.ReadString('\n')
+	assert.Equal(t, ":bar.example.com FAIL SETNAME INVALID_REALNAME :Realname is not valid\r\n", r)
+
+	writeAndFlush(withoutCap, "SETNAME :Jane Doe\r\n")
+	r, _ = withoutCap.ReadString('\n')
+	assert.Equal(t, ":bar.example.com FAIL SETNAME CANNOT_CHANGE_REALNAME :The setname capability is not enabled\r\n", r)
+}
+
+func TestChghost(t *testing.T) {
+	server := MakeServer("bar.example.com")
+
+	var newTestConn = func(nick string, caps string) (client *bufio.ReadWriter) {
+		client, serverConn := makeTestConn()
+		newIrcConnection(server, serverConn)
+		writeAndFlush(client, fmt.Sprintf("CAP REQ :%v\r\n", caps))
+		discardResponse(client, 1)
+		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+		writeAndFlush(client, "CAP END\r\n")
+		discardRegistration(client)
+
+		return
+	}
+
+	guest := newTestConn("guest", "chghost")
+	withCap := newTestConn("withcap", "chghost")
+	withoutCap := newTestConn("withoutcap", "setname")
+	for _, channel := range []string{"#test1", "#test2"} {
+		writeAndFlush(guest, fmt.Sprintf("JOIN %v\r\n", channel))
+		discardResponse(guest, 4)
+		writeAndFlush(withCap, fmt.Sprintf("JOIN %v\r\n", channel))
+		discardResponse(withCap, 4)
+		discardResponse(guest, 1)
+		writeAndFlush(withoutCap, fmt.Sprintf("JOIN %v\r\n", channel))
+		discardResponse(withoutCap, 4)
+		discardResponse(guest, 1)
+		discardResponse(withCap, 1)
+	}
+
+	// MODE +x and -x change the host to and from the cloak, see TestCloaking.
+	// Send it to the server directly here to pick the host.
+	// The server blocks until the messages are read.
+	go sendCommandToServer(server.commandChan, CHANGE_HOST, "guest", []string{"~guest", "cloaked.example.com"})
+
+	// Read concurrently as the order the server sends in is not fixed
+	var readLines = func(client *bufio.ReadWriter, n int) chan []string {
+		result := make(chan []string, 1)
+		go func() {
+			response := []string{}
+			for _ = range n {
+				r, _ := client.ReadString('\n')
+				response = append(response, r)
+			}
+			result <- response
+		}()
+		return result
+	}
+	guestResponse := readLines(guest, 1)
+	withCapResponse := readLines(withCap, 1)
+	withoutCapResponse := readLines(withoutCap, 3)
+
+	expected := []string{":guest!guest@pipe CHGHOST ~guest cloaked.example.com\r\n"}
+	assert.Equal(t, expected, <-guestResponse)
+	assert.Equal(t, expected, <-withCapResponse)
+
+	// Once for each shared channel
+	expectedFallback := []string{
+		":guest!guest@pipe QUIT :Changing host\r\n",
+		":guest!~guest@cloaked.example.com JOIN #test1\r\n",
+		":guest!~guest@cloaked.example.com JOIN #test2\r\n",
+	}
+	assert.Equal(t, expectedFallback, <-withoutCapResponse)
+	assert.Zero(t, withoutCap.Reader.Buffered())
+}
+
+func TestOper(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{"RPL_YOUREOPER", "OPER admin hunter2\r\n", []string{
+			":bar.example.com 381 guest :You are now an IRC operator\r\n",
+			":guest MODE guest :+o\r\n",
+		}},
+		{"ERR_PASSWDMISMATCH", "OPER admin hunter3\r\n", []string{
+			":bar.example.com 464 guest :Password incorrect\r\n",
+		}},
+		{"ERR_NOOPERHOST for unknown name", "OPER foo hunter2\r\n", []string{
+			":bar.example.com 491 guest :No O-lines for your host\r\n",
+		}},
+		{"ERR_NOOPERHOST for wrong host", "OPER remote hunter2\r\n", []string{
+			":bar.example.com 491 guest :No O-lines for your host\r\n",
+		}},
+		{"ERR_NEEDMOREPARAMS", "OPER admin\r\n", []string{
+			":bar.example.com 461 guest OPER :Not enough parameters\r\n",
+		}},
+	}
+
+	password := hashPassword("hunter2")
+	config := DefaultConfig("bar.example.com")
+	config.Opers = []OperConfig{
+		{"admin", password, []string{"*@pipe"}, "netadmin"},
+		{"remote", password, []string{"*@*.example.com"}, "netadmin"},
+	}
+	config.OperClasses = []OperClassConfig{{"netadmin", []string{"kill"}}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := MakeServerFromConfig(config)
+
+			client, serverConn := makeTestConn()
+			newIrcConnection(server, serverConn)
+			writeAndFlush(client, "NICK guest\r\n")
+			writeAndFlush(client, "USER guest 0 * :Joe Bloggs\r\n")
+			discardRegistration(client)
+
+			writeAndFlush(client, tt.input)
+			response := []string{}
+			for _ = range tt.expected {
+				r, _ := client.ReadString('\n')
+				response = append(response, r)
+			}
+
+			assert.Equal(t, tt.expected, response)
+			assert.Zero(t, client.Reader.Buffered())
+		})
+	}
+}
+
+func TestPasswordHashing(t *testing.T) {
+	// First block of the RFC 7914 test vector
+	expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"
+	key := pbkdf2Sha256([]byte("passwd"), []byte("salt"), 1)
+	assert.Equal(t, expected, fmt.Sprintf("%x", key))
+
+	hash := hashPassword("hunter2")
+	assert.True(t, checkPassword(hash, "hunter2"))
+	assert.False(t, checkPassword(hash, "hunter3"))
+	assert.NotEqual(t, hash, hashPassword("hunter2"))
+	assert.False(t, checkPassword("hunter2", "hunter2"))
+}
+
+func TestUserModes(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{"RPL_UMODEIS", "MODE guest\r\n", []string{
+			":bar.example.com 221 guest +\r\n",
+		}},
+		{"set modes", "MODE guest +wi\r\n", []string{
+			":guest MODE guest :+wi\r\n",
+		}},
+		{"own nick in another case", "MODE GUEST +i\r\n", []string{
+			":guest MODE guest :+i\r\n",
+		}},
+		{"cannot grant operator status", "MODE guest +o\r\n", []string{
+			"\r\n",
+		}},
+		{"ERR_UMODEUNKNOWNFLAG", "MODE guest +wz\r\n", []string{
+			":bar.example.com 501 guest :Unknown MODE flag\r\n",
+			":guest MODE guest :+w\r\n",
+		}},
+		{"ERR_USERSDONTMATCH", "MODE other +w\r\n", []string{
+			":bar.example.com 502 guest :Cannot change mode for other users\r\n",
+		}},
+		{"ERR_NEEDMOREPARAMS", "MODE\r\n", []string{
+			":bar.example.com 461 guest MODE :Not enough parameters\r\n",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := MakeServer("bar.example.com")
+
+			client, serverConn := makeTestConn()
+			newIrcConnection(server, serverConn)
+			writeAndFlush(client, "NICK guest\r\n")
+			writeAndFlush(client, "USER guest 0 * :Joe Bloggs\r\n")
+			discardRegistration(client)
+
+			writeAndFlush(client, tt.input)
+			response := []string{}
+			for _ = range tt.expected {
+				r, _ := client.ReadString('\n')
+				response = append(response, r)
+			}
+
+			assert.Equal(t, tt.expected, response)
+			assert.Zero(t, client.Reader.Buffered())
+		})
+	}
+}
+
+func TestQuitIsSentToChannels(t *testing.T) {
+	server := MakeServer("bar.example.com")
+
+	var newTestConn = func(nick string) (client *bufio.ReadWriter) {
+		client, serverConn := makeTestConn()
+		newIrcConnection(server, serverConn)
+		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+		discardRegistration(client)
+		writeAndFlush(client, "JOIN #test\r\n")
+		discardResponse(client, 4)
+
+		return
+	}
+
+	peer := newTestConn("peer")
+	guest := newTestConn("guest")
+	discardResponse(peer, 1)
+
+	writeAndFlush(guest, "QUIT :Gone to have lunch\r\n")
+	discardResponse(guest, 1)
+	r, _ := peer.ReadString('\n')
+	assert.Equal(t, ":guest!guest@pipe QUIT :Gone to have lunch\r\n", r)
+
+	// Check user has been removed from the channel
+	writeAndFlush(peer, "NAMES #test\r\n")
+	r, _ = peer.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 353 peer = #test :+peer\r\n", r)
+	discardResponse(peer, 1)
+}
+
+// Registers a user and makes them an operator with the given privileges
+func newTestOperServer(privileges []string) ServerInfo {
+	config := DefaultConfig("bar.example.com")
+	config.Opers = []OperConfig{{"admin", hashPassword("hunter2"), []string{"*@*"}, "staff"}}
+	config.OperClasses = []OperClassConfig{{"staff", privileges}}
+
+	return MakeServerFromConfig(config)
+}
+
+func TestKill(t *testing.T) {
+	server := newTestOperServer([]string{"kill"})
+
+	var newTestConn = func(nick string) (client *bufio.ReadWriter, serverConn net.Conn) {
+		client, serverConn = makeTestConn()
+		newIrcConnection(server, serverConn)
+		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+		discardRegistration(client)
+		writeAndFlush(client, "JOIN #test\r\n")
+		discardResponse(client, 4)
+
+		return
+	}
+
+	oper, _ := newTestConn("oper")
+	writeAndFlush(oper, "OPER admin hunter2\r\n")
+	discardResponse(oper, 2)
+	victim, victimConn := newTestConn("victim")
+	discardResponse(oper, 1)
+
+	writeAndFlush(oper, "KILL victim :Spamming\r\n")
+
+	r, _ := victim.ReadString('\n')
+	assert.Equal(t, ":oper!oper@pipe KILL victim :Spamming\r\n", r)
+	r, _ = victim.ReadString('\n')
+	assert.Equal(t, ":bar.example.com ERROR :Closing Link: pipe Killed (oper (Spamming))\r\n", r)
+
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, ":victim!victim@pipe QUIT :Killed (oper (Spamming))\r\n", r)
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, "\r\n", r)
+
+	// Connection has been closed
+	_, err := victimConn.Read([]byte{})
+	assert.NotNil(t, err)
+
+	// Nick has been released
+	writeAndFlush(oper, "KILL victim :Spamming\r\n")
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 401 oper victim :No such nick/channel\r\n", r)
+	assert.Zero(t, oper.Reader.Buffered())
+}
+
+func TestOperCommandErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		oper     bool
+		input    string
+		expected string
+	}{
+		{"KILL ERR_NOPRIVILEGES", false, "KILL guest :Spamming\r\n", ":bar.example.com 481 guest :Permission Denied- You're not an IRC operator\r\n"},
+		{"KILL ERR_NOPRIVILEGES without privilege", true, "KILL guest :Spamming\r\n", ":bar.example.com 481 guest :Permission Denied- You're not an IRC operator\r\n"},
+		{"KILL ERR_NEEDMOREPARAMS", true, "KILL guest\r\n", ":bar.example.com 461 guest KILL :Not enough parameters\r\n"},
+		{"WALLOPS ERR_NOPRIVILEGES", false, "WALLOPS :Hello\r\n", ":bar.example.com 481 guest :Permission Denied- You're not an IRC operator\r\n"},
+		{"WALLOPS ERR_NEEDMOREPARAMS", true, "WALLOPS\r\n", ":bar.example.com 461 guest WALLOPS :Not enough parameters\r\n"},
+		{"GLOBOPS ERR_NOPRIVILEGES", false, "GLOBOPS :Hello\r\n", ":bar.example.com 481 guest :Permission Denied- You're not an IRC operator\r\n"},
+		{"GLOBOPS ERR_NEEDMOREPARAMS", true, "GLOBOPS\r\n", ":bar.example.com 461 guest GLOBOPS :Not enough parameters\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestOperServer([]string{"wallops", "globops"})
+
+			client, serverConn := makeTestConn()
+			newIrcConnection(server, serverConn)
+			writeAndFlush(client, "NICK guest\r\n")
+			writeAndFlush(client, "USER guest 0 * :Joe Bloggs\r\n")
+			discardRegistration(client)
+			if tt.oper {
+				writeAndFlush(client, "OPER admin hunter2\r\n")
+				discardResponse(client, 2)
+			}
+
+			writeAndFlush(client, tt.input)
+			r, _ := client.ReadString('\n')
+
+			assert.Equal(t, tt.expected, r)
+			assert.Zero(t, client.Reader.Buffered())
+		})
+	}
+}
+
+func TestWallopsAndGlobops(t *testing.T) {
+	server := newTestOperServer([]string{"wallops", "globops"})
+
+	var newTestConn = func(nick string) (client *bufio.ReadWriter) {
+		client, serverConn := makeTestConn()
+		newIrcConnection(server, serverConn)
+		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+		discardRegistration(client)
+
+		return
+	}
+
+	oper := newTestConn("oper")
+	writeAndFlush(oper, "OPER admin hunter2\r\n")
+	discardResponse(oper, 2)
+	listener := newTestConn("listener")
+	writeAndFlush(listener, "MODE listener +w\r\n")
+	discardResponse(listener, 1)
+	other := newTestConn("other")
+
+	// Only +w users receive WALLOPS
+	writeAndFlush(oper, "WALLOPS :Server restarting\r\n")
+	r, _ := listener.ReadString('\n')
+	assert.Equal(t, ":oper!oper@pipe WALLOPS :Server restarting\r\n", r)
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, "\r\n", r)
+
+	// Only operators receive GLOBOPS
+	writeAndFlush(oper, "GLOBOPS :Watch out for spam\r\n")
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com NOTICE oper :*** Global -- from oper: Watch out for spam\r\n", r)
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, "\r\n", r)
+
+	assert.Zero(t, listener.Reader.Buffered())
+	assert.Zero(t, other.Reader.Buffered())
+}
+
+func TestKline(t *testing.T) {
+	config := DefaultConfig("bar.example.com")
+	config.Opers = []OperConfig{{"admin", hashPassword("hunter2"), []string{"*@*"}, "staff"}}
+	config.OperClasses = []OperClassConfig{{"staff", []string{"kline"}}}
+	config.BanFile = t.TempDir() + "/bans.json"
+	server := MakeServerFromConfig(config)
+
+	var newTestConn = func(server ServerInfo, nick string) (client *bufio.ReadWriter, serverConn net.Conn) {
+		client, serverConn = makeTestConn()
+		newIrcConnection(server, serverConn)
+		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+
+		return
+	}
+
+	oper, _ := newTestConn(server, "oper")
+	discardRegistration(oper)
+	writeAndFlush(oper, "OPER admin hunter2\r\n")
+	discardResponse(oper, 2)
+	victim, victimConn := newTestConn(server, "victim")
+	discardRegistration(victim)
+
+	// Connected users who match are disconnected
+	writeAndFlush(oper, "KLINE 60 victim@* :Spamming\r\n")
+	r, _ := victim.ReadString('\n')
+	assert.Equal(t, ":bar.example.com ERROR :Closing Link: pipe K-lined (Spamming)\r\n", r)
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com NOTICE oper :Added K-line for [victim@*]\r\n", r)
+	_, err := victimConn.Read([]byte{})
+	assert.NotNil(t, err)
+
+	// New connections are rejected at registration
+	victim, _ = newTestConn(server, "victim")
+	r, _ = victim.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 465 * :You are banned from this server- Spamming\r\n", r)
+	r, _ = victim.ReadString('\n')
+	assert.Equal(t, ":bar.example.com ERROR :Closing Link: pipe K-lined (Spamming)\r\n", r)
+
+	// Bans are kept after a restart
+	restarted := MakeServerFromConfig(config)
+	victim, _ = newTestConn(restarted, "victim")
+	r, _ = victim.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 465 * :You are banned from this server- Spamming\r\n", r)
+
+	writeAndFlush(oper, "UNKLINE victim@*\r\n")
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com NOTICE oper :Removed K-line for [victim@*]\r\n", r)
+	writeAndFlush(oper, "UNKLINE victim@*\r\n")
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com NOTICE oper :No K-line for [victim@*]\r\n", r)
+
+	victim, _ = newTestConn(server, "victim")
+	r, _ = victim.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 001 victim :Welcome to the Internet Relay Network victim!victim@pipe\r\n", r)
+
+	// A nick bans the host the user is connected from, so it must be in use
+	writeAndFlush(oper, "KLINE nobody\r\n")
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 401 oper nobody :No such nick/channel\r\n", r)
+	assert.Zero(t, oper.Reader.Buffered())
+}
+
+func TestExpiredBansAreRemoved(t *testing.T) {
+	path := t.TempDir() + "/bans.json"
+	past := time.Now().Add(-time.Hour)
+	bans := banList{
+		[]ban{{"*@pipe", "Old", "oper", past, past.Add(time.Minute)}},
+		[]ban{{"10.0.0.0/8", "Permanent", "oper", past, time.Time{}}},
+	}
+	assert.Nil(t, saveBans(path, bans))
+
+	config := DefaultConfig("bar.example.com")
+	config.BanFile = path
+	server := MakeServerFromConfig(config)
+
+	client, serverConn := makeTestConn()
+	newIrcConnection(server, serverConn)
+	writeAndFlush(client, "NICK foo\r\n")
+	writeAndFlush(client, "USER foo 0 * :Joe Bloggs\r\n")
+	r, _ := client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 001 foo :Welcome to the Internet Relay Network foo!foo@pipe\r\n", r)
+	discardRegistration(client)
+
+	bans, err := loadBans(path)
+	assert.Nil(t, err)
+	assert.Empty(t, bans.Klines)
+	assert.Len(t, bans.Dlines, 1)
+}
+
+func TestDline(t *testing.T) {
+	server := newTestOperServer([]string{"dline"})
+
+	oper, serverConn := makeTestConn()
+	newIrcConnection(server, serverConn)
+	writeAndFlush(oper, "NICK oper\r\n")
+	writeAndFlush(oper, "USER oper 0 * :Joe Bloggs\r\n")
+	discardRegistration(oper)
+	writeAndFlush(oper, "OPER admin hunter2\r\n")
+	discardResponse(oper, 2)
+
+	writeAndFlush(oper, "DLINE 127.0.0.300 :Bad\r\n")
+	r, _ := oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com NOTICE oper :Invalid D-line [127.0.0.300]\r\n", r)
+	writeAndFlush(oper, "DLINE 127.0.0.0/8 :Bad\r\n")
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com NOTICE oper :Added D-line for [127.0.0.0/8]\r\n", r)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	var acceptAndCheck = func() (client *bufio.Reader, rejected bool) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		assert.Nil(t, err)
+		conn.SetDeadline(time.Now().Add(time.Second))
+		accepted, err := l.Accept()
+		assert.Nil(t, err)
+		defer accepted.Close()
+
+		return bufio.NewReader(conn), rejectIfBanned(server, accepted)
+	}
+
+	client, rejected := acceptAndCheck()
+	assert.True(t, rejected)
+	r, _ = client.ReadString('\n')
+	assert.Equal(t, "ERROR :Closing Link: 127.0.0.1 D-lined (Bad)\r\n", r)
+
+	writeAndFlush(oper, "UNDLINE 127.0.0.0/8\r\n")
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com NOTICE oper :Removed D-line for [127.0.0.0/8]\r\n", r)
+
+	_, rejected = acceptAndCheck()
+	assert.False(t, rejected)
+	assert.Zero(t, oper.Reader.Buffered())
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, err := LoadConfig("ircd.example.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, "irc.example.com", config.Name)
+	assert.Equal(t, "ExampleNet", config.Network)
+	assert.Equal(t, []ListenerConfig{{Address: ":6667"}}, config.Listeners)
+	assert.Equal(t, []ClassConfig{{Name: "default", PingFrequency: 2 * time.Minute, PingTimeout: 2 * time.Minute, RegistrationTimeout: 30 * time.Second,
+		FloodBurst: 20, FloodInterval: 500 * time.Millisecond, FloodLimit: 100, SendQ: 400 * 1024},
+		{Name: "bots", PingFrequency: 5 * time.Minute, FloodExempt: true, SendQ: 1024 * 1024}}, config.Classes)
+	assert.Equal(t, ClassConfig{Name: "bots", PingFrequency: 5 * time.Minute, PingTimeout: 2 * time.Minute, RegistrationTimeout: 30 * time.Second,
+		FloodBurst: 20, FloodInterval: 500 * time.Millisecond, FloodLimit: 100, FloodExempt: true, SendQ: 1024 * 1024}, findClass(config, "bots"))
+	assert.Equal(t, defaultClassConfig, findClass(DefaultConfig(""), defaultClass))
+	assert.Equal(t, "bans.json", config.BanFile)
+	assert.Equal(t, LimitsConfig{MaxClients: 1000, MaxPerIP: 10, ThrottleCount: 10, ThrottleWindow: time.Minute, IPv4Cidr: 32, IPv6Cidr: 64,
+		Exempt: []string{"127.0.0.1", "::1"}}, config.Limits)
+	// The example oper block is commented out, so there is no known password
+	assert.Empty(t, config.Opers)
+	assert.Len(t, config.OperClasses, 2)
+
+	path := t.TempDir() + "/ircd.yaml"
+	var loadConfig = func(contents string) error {
+		os.WriteFile(path, []byte(contents), 0600)
+		_, err := LoadConfig(path)
+		return err
+	}
+
+	// Defaults are kept
+	err = loadConfig("name: irc.example.com\nlisteners: [{address: \":6667\"}]\n")
+	assert.Nil(t, err)
+	config, _ = LoadConfig(path)
+	assert.Equal(t, 30, config.NickLength)
+	assert.Equal(t, "rfc1459", config.Casemapping)
+
+	err = loadConfig("name: irc.example.com\nlisteners: [{address: \":6667\"}]\nnicklength: 9\n")
+	assert.ErrorContains(t, err, "field nicklength not found")
+
+	err = loadConfig(`
+listeners: [{address: "6667"}]
+casemapping: unicode
+nick_length: 0
+oper_classes:
+  - {name: staff, privileges: [kill, fly]}
+opers:
+  - {name: admin, password: hunter2, class: missing}
+`)
+	assert.ErrorContains(t, err, "name must be set")
+	assert.ErrorContains(t, err, `listeners[0]: invalid address "6667", expected host:port`)
+	assert.ErrorContains(t, err, `casemapping: unsupported casemapping "unicode"`)
+	assert.ErrorContains(t, err, "nick_length must be at least 1")
+	assert.ErrorContains(t, err, `oper class "staff": unknown privilege "fly"`)
+	assert.ErrorContains(t, err, `oper "admin": password must be a hash from mkpasswd`)
+	assert.ErrorContains(t, err, `oper "admin": at least one host is required`)
+	assert.ErrorContains(t, err, `oper "admin": unknown class "missing"`)
+
+	err = loadConfig(`
+name: irc.example.com
+listeners:
+  - {address: ":6697", certificate: missing.crt}
+  - {address: ":6698", certificate: missing.crt, key: missing.key}
+`)
+	assert.ErrorContains(t, err, "listeners[0]: certificate and key must both be set")
+	assert.ErrorContains(t, err, "listeners[1]: open missing.crt: no such file or directory")
+
+	err = loadConfig(`
+name: irc.example.com
+listeners:
+  - {address: ":6667", proxy: true}
+  - {address: ":6668", proxy: true, proxy_from: [10.0.0.0/8, lb.example.com]}
+  - {address: /run/ircd.sock, proxy: true}
+`)
+	assert.ErrorContains(t, err, "listeners[0]: proxy_from is required with proxy")
+	assert.ErrorContains(t, err, `listeners[1]: invalid proxy_from host "lb.example.com", expected an IP or CIDR range`)
+	assert.NotContains(t, err.Error(), "listeners[2]")
+
+	err = loadConfig(`
+name: irc.example.com
+listeners:
+  - {address: /run/ircd.sock, class: bots}
+  - {address: "[::1]:6667", class: default}
+classes: [{name: web}, {name: web, ping_timeout: -1s, flood_limit: -1, sendq: 100}]
+`)
+	assert.ErrorContains(t, err, `classes: class "web" is defined more than once`)
+	assert.ErrorContains(t, err, `class "web": ping_frequency, ping_timeout and registration_timeout must not be negative`)
+	assert.ErrorContains(t, err, `class "web": flood_burst, flood_interval and flood_limit must not be negative`)
+	assert.ErrorContains(t, err, `class "web": sendq must be at least 512 bytes`)
+	assert.ErrorContains(t, err, `listeners[0]: unknown class "bots"`)
+	assert.NotContains(t, err.Error(), "listeners[1]")
+
+	err = loadConfig("name: irc.example.com\nlisteners: [{address: \":6667\"}]\ncloak_key: secret\n")
+	assert.EqualError(t, err, path+": cloak_key must be at least 16 characters")
+
+	err = loadConfig(`
+name: irc.example.com
+listeners: [{address: ":6667"}]
+classes: [{name: default, password: plain}]
+webirc: [{name: web, password: plain, hosts: [192.0.2.0/33]}, {password: plain}]
+accounts: [{name: alice}, {name: alice, certfp: abc}, {password: plain}]
+`)
+	assert.ErrorContains(t, err, `class "default": password must be a hash from mkpasswd`)
+	assert.ErrorContains(t, err, `webirc "web": password must be a hash from mkpasswd`)
+	assert.ErrorContains(t, err, `webirc "web": invalid host "192.0.2.0/33", expected an IP or CIDR range`)
+	assert.ErrorContains(t, err, "webirc: every gateway needs a name")
+	assert.ErrorContains(t, err, `webirc "": at least one host is required`)
+	assert.ErrorContains(t, err, `account "alice": a password or certfp is required`)
+	assert.ErrorContains(t, err, `accounts: account "alice" is defined more than once`)
+	assert.ErrorContains(t, err, `account "alice": certfp must be a hex SHA-256 fingerprint`)
+	assert.ErrorContains(t, err, "accounts: every account needs a name")
+	assert.ErrorContains(t, err, `account "": password must be a hash from mkpasswd`)
+
+	err = loadConfig(`
+name: irc.example.com
+listeners: [{address: ":6667"}]
+limits: {max_per_ip: -1, throttle_window: 0s, ipv6_cidr: 129, exempt: [example.com]}
+`)
+	assert.ErrorContains(t, err, "limits: max_clients, max_per_ip, throttle_count and throttle_window must not be negative")
+	assert.ErrorContains(t, err, "limits: throttle_window is required with throttle_count")
+	assert.ErrorContains(t, err, "limits: ipv4_cidr must be from 0 to 32 and ipv6_cidr from 0 to 128")
+	assert.ErrorContains(t, err, `limits: invalid exempt host "example.com", expected an IP or CIDR range`)
+}
+
+func TestNetworkIsupport(t *testing.T) {
+	config := DefaultConfig("bar.example.com")
+	config.Network = "ExampleNet"
+	server := MakeServerFromConfig(config)
+
+	_, isupport := sendCommandToServer(server.commandChan, ISUPPORT, "", []string{})
+	assert.Equal(t, "CASEMAPPING=rfc1459 MONITOR=100 NETWORK=ExampleNet NICKLEN=30", isupport)
+}
+
+func TestRehash(t *testing.T) {
+	path := t.TempDir() + "/ircd.yaml"
+	const base = `
+name: bar.example.com
+listeners: [{address: ":6667"}]
+oper_classes: [{name: staff, privileges: [rehash]}]
+`
+	const oper = `opers:
+  - {name: admin, password: "%v", hosts: ["*@*"], class: staff}
+`
+	password := hashPassword("hunter2")
+	os.WriteFile(path, []byte(base+fmt.Sprintf(oper, password)), 0600)
+	config, err := LoadConfig(path)
+	assert.Nil(t, err)
+	server := MakeServerFromConfig(config)
+
+	client, serverConn := makeTestConn()
+	newIrcConnection(server, serverConn)
+	writeAndFlush(client, "NICK admin\r\n")
+	writeAndFlush(client, "USER admin 0 * :Joe Bloggs\r\n")
+	discardRegistration(client)
+	writeAndFlush(client, "OPER admin hunter2\r\n")
+	discardResponse(client, 2)
+
+	var rehashAndRead = func(lines int) []string {
+		writeAndFlush(client, "REHASH\r\n")
+		r, _ := client.ReadString('\n')
+		assert.Equal(t, fmt.Sprintf(":bar.example.com 382 admin %v :Rehashing\r\n", path), r)
+
+		responses := []string{}
+		for range lines {
+			r, _ := client.ReadString('\n')
+			responses = append(responses, r)
+		}
+		return responses
+	}
+
+	assert.Equal(t, []string{":bar.example.com NOTICE admin :Rehash: No changes\r\n"}, rehashAndRead(1))
+
+	// Changes are applied, and clients are told about new limits
+	os.WriteFile(path, []byte(base+"monitor_limit: 5\n"+fmt.Sprintf(oper, password)+`  - {name: helper, password: "`+password+`", hosts: ["*@*"], class: staff}
+`), 0600)
+	assert.Equal(t, []string{
+		":bar.example.com 005 admin CASEMAPPING=rfc1459 MONITOR=5 NICKLEN=30 :are supported by this server\r\n",
+		":bar.example.com NOTICE admin :Rehash: monitor_limit changed from \"100\" to \"5\"\r\n",
+		":bar.example.com NOTICE admin :Rehash: oper \"helper\" added\r\n",
+	}, rehashAndRead(3))
+	_, isupport := sendCommandToServer(server.commandChan, ISUPPORT, "", []string{})
+	assert.Equal(t, "CASEMAPPING=rfc1459 MONITOR=5 NICKLEN=30", isupport)
+
+	// Invalid configs are rejected and the running config is kept
+	os.WriteFile(path, []byte(base+"nick_length: 0\ncasemapping: fancy\n"), 0600)
+	assert.Equal(t, []string{
+		fmt.Sprintf(":bar.example.com NOTICE admin :Rehash failed: %v: casemapping: unsupported casemapping \"fancy\"\r\n", path),
+		":bar.example.com NOTICE admin :Rehash failed: nick_length must be at least 1\r\n",
+	}, rehashAndRead(2))
+
+	os.WriteFile(path, []byte(base+"casemapping: ascii\n"), 0600)
+	assert.Equal(t, []string{
+		":bar.example.com NOTICE admin :Rehash failed: casemapping can't be changed without a restart\r\n",
+	}, rehashAndRead(1))
+	_, isupport = sendCommandToServer(server.commandChan, ISUPPORT, "", []string{})
+	assert.Equal(t, "CASEMAPPING=rfc1459 MONITOR=5 NICKLEN=30", isupport)
+	assert.Zero(t, client.Reader.Buffered())
+
+	// Operators already online get the privileges of their changed block
+	result, _ := sendCommandToServer(server.commandChan, HAS_PRIVILEGE, "admin", []string{"wallops"})
+	assert.Equal(t, ERR_NOPRIVILEGES, result)
+	os.WriteFile(path, []byte(strings.Replace(base, "[rehash]", "[rehash, wallops]", 1)+"monitor_limit: 5\n"+fmt.Sprintf(oper, password)), 0600)
+	assert.Equal(t, []string{
+		":bar.example.com NOTICE admin :Rehash: oper \"helper\" removed\r\n",
+		":bar.example.com NOTICE admin :Rehash: oper class \"staff\" changed\r\n",
+	}, rehashAndRead(2))
+	result, _ = sendCommandToServer(server.commandChan, HAS_PRIVILEGE, "admin", []string{"wallops"})
+	assert.Equal(t, OK, result)
+
+	// and stop being operators if it is removed
+	os.WriteFile(path, []byte(base+"monitor_limit: 5\n"), 0600)
+	assert.Equal(t, []string{
+		":admin MODE admin :-o\r\n",
+		":bar.example.com NOTICE admin :Rehash: oper \"admin\" removed\r\n",
+		":bar.example.com NOTICE admin :Rehash: oper class \"staff\" changed\r\n",
+	}, rehashAndRead(3))
+	writeAndFlush(client, "REHASH\r\n")
+	r, _ := client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 481 admin :Permission Denied- You're not an IRC operator\r\n", r)
+	assert.Zero(t, client.Reader.Buffered())
+
+	// Without a config file there is nothing to reload
+	_, err = rehash(newTestOperServer([]string{"rehash"}))
+	assert.EqualError(t, err, "the server was not started with a config file")
+}
+
+func TestDie(t *testing.T) {
+	server := newTestOperServer([]string{"die"})
+
+	oper, operConn := makeTestConn()
+	newIrcConnection(server, operConn)
+	writeAndFlush(oper, "NICK oper\r\n")
+	writeAndFlush(oper, "USER oper 0 * :Joe Bloggs\r\n")
+	discardRegistration(oper)
+
+	// Needs the privilege
+	writeAndFlush(oper, "DIE\r\n")
+	r, _ := oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 481 oper :Permission Denied- You're not an IRC operator\r\n", r)
+
+	writeAndFlush(oper, "OPER admin hunter2\r\n")
+	discardResponse(oper, 2)
+
+	// Connections which haven't registered are closed too
+	unregistered, unregisteredConn := makeTestConn()
+	newIrcConnection(server, unregisteredConn)
+
+	writeAndFlush(oper, "DIE :Upgrading\r\n")
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com ERROR :Closing Link: pipe Server shutting down (DIE by oper: Upgrading)\r\n", r)
+	// Listeners can stop accepting before every connection has closed
+	select {
+	case <-server.stopping:
+	default:
+		assert.Fail(t, "Shutdown did not start")
+	}
+	r, _ = unregistered.ReadString('\n')
+	assert.Equal(t, ":bar.example.com ERROR :Closing Link: pipe Server shutting down (DIE by oper: Upgrading)\r\n", r)
+
+	_, err := operConn.Read([]byte{})
+	assert.NotNil(t, err)
+	_, err = unregisteredConn.Read([]byte{})
+	assert.NotNil(t, err)
+
+	select {
+	case shutdown := <-server.stopped:
+		assert.Equal(t, Shutdown{"DIE by oper: Upgrading", false}, shutdown)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Server did not stop")
+	}
+
+	// Such as SIGTERM arriving after the server has stopped, which mustn't block
+	done := make(chan bool)
+	go func() {
+		shutdownServer(server, "Received terminated", false)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "Shutdown blocked after the server stopped")
+	}
+}
+
+func TestRestart(t *testing.T) {
+	server := newTestOperServer([]string{"restart"})
+
+	oper, operConn := makeTestConn()
+	newIrcConnection(server, operConn)
+	writeAndFlush(oper, "NICK oper\r\n")
+	writeAndFlush(oper, "USER oper 0 * :Joe Bloggs\r\n")
+	discardRegistration(oper)
+	writeAndFlush(oper, "OPER admin hunter2\r\n")
+	discardResponse(oper, 2)
+
+	writeAndFlush(oper, "RESTART\r\n")
+	r, _ := oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com ERROR :Closing Link: pipe Server restarting (RESTART by oper)\r\n", r)
+
+	select {
+	case shutdown := <-server.stopped:
+		assert.True(t, shutdown.restart)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Server did not stop")
+	}
+}
+
+func TestStats(t *testing.T) {
+	server := newTestOperServer([]string{"stats"})
+
+	client, serverConn := makeTestConn()
+	newIrcConnection(server, serverConn)
+	writeAndFlush(client, "NICK oper\r\n")
+	writeAndFlush(client, "USER oper 0 * :Joe Bloggs\r\n")
+	discardRegistration(client)
+
+	var stats = func(query string) []string {
+		writeAndFlush(client, query+"\r\n")
+		replies := []string{}
+		for {
+			r, err := client.ReadString('\n')
+			replies = append(replies, r)
+			if err != nil || strings.Contains(r, " 219 ") || strings.Contains(r, " 461 ") || strings.Contains(r, " 481 ") {
+				return replies
+			}
+		}
+	}
+
+	assert.Equal(t, []string{":bar.example.com 461 oper STATS :Not enough parameters\r\n"}, stats("STATS"))
+	assert.Equal(t, []string{":bar.example.com 481 oper :Permission Denied- You're not an IRC operator\r\n"}, stats("STATS o"))
+
+	replies := stats("STATS u")
+	assert.Len(t, replies, 2)
+	assert.Regexp(t, `^:bar.example.com 242 oper :Server Up 0 days 0:00:0\d\r\n$`, replies[0])
+	assert.Equal(t, ":bar.example.com 219 oper u :End of STATS report\r\n", replies[1])
+
+	writeAndFlush(client, "OPER admin hunter2\r\n")
+	discardResponse(client, 2)
+
+	assert.Equal(t, []string{
+		":bar.example.com 212 oper NICK 1 11 0\r\n",
+		":bar.example.com 212 oper OPER 1 20 0\r\n",
+		":bar.example.com 212 oper STATS 4 34 0\r\n",
+		":bar.example.com 212 oper USER 1 27 0\r\n",
+		":bar.example.com 219 oper m :End of STATS report\r\n",
+	}, stats("STATS m"))
+
+	replies = stats("STATS l")
+	assert.Len(t, replies, 2)
+	assert.Regexp(t, `^:bar.example.com 211 oper oper\[oper@pipe\] \d+ \d+ \d+ 8 101 \d+\r\n$`, replies[0])
+
+	assert.Equal(t, []string{
+		":bar.example.com 243 oper O *@* * admin 0 staff\r\n",
+		":bar.example.com 219 oper o :End of STATS report\r\n",
+	}, stats("STATS o"))
+
+	sendCommandToServer(server.commandChan, ADD_KLINE, "oper", []string{"*@evil.example.com", "0", "Spam"})
+	sendCommandToServer(server.commandChan, ADD_DLINE, "oper", []string{"10.0.0.0/8", "0", "Proxies"})
+	assert.Equal(t, []string{
+		":bar.example.com 216 oper K evil.example.com * * 0 :Spam (set by oper)\r\n",
+		":bar.example.com 225 oper D 10.0.0.0/8 :Proxies (set by oper)\r\n",
+		":bar.example.com 219 oper k :End of STATS report\r\n",
+	}, stats("STATS k"))
+
+	assert.Equal(t, []string{
+		":bar.example.com 218 oper Y default 120 0 0 409600\r\n",
+		":bar.example.com 219 oper y :End of STATS report\r\n",
+	}, stats("STATS y"))
+	assert.Equal(t, []string{":bar.example.com 219 oper x :End of STATS report\r\n"}, stats("STATS x"))
+	assert.Zero(t, client.Reader.Buffered())
+}
+
+func TestInformationalCommands(t *testing.T) {
+	config := DefaultConfig("bar.example.com")
+	config.Admin = AdminConfig{"Example City", "Example Ltd", "admin@example.com"}
+	server := MakeServerFromConfig(config)
+
+	client, serverConn := makeTestConn()
+	newIrcConnection(server, serverConn)
+	writeAndFlush(client, "NICK nick\r\n")
+	writeAndFlush(client, "USER user 0 * :Joe Bloggs\r\n")
+	discardRegistration(client)
+
+	var readLines = func(lines int) []string {
+		replies := []string{}
+		for range lines {
+			r, _ := client.ReadString('\n')
+			replies = append(replies, r)
+		}
+		return replies
+	}
+
+	writeAndFlush(client, "ADMIN\r\n")
+	assert.Equal(t, []string{
+		":bar.example.com 256 nick bar.example.com :Administrative info\r\n",
+		":bar.example.com 257 nick :Example City\r\n",
+		":bar.example.com 258 nick :Example Ltd\r\n",
+		":bar.example.com 259 nick :admin@example.com\r\n",
+	}, readLines(4))
+
+	writeAndFlush(client, "INFO bar.example.com\r\n")
+	assert.Equal(t, []string{
+		":bar.example.com 371 nick :IRC server version 0.0\r\n",
+		fmt.Sprintf(":bar.example.com 371 nick :Built with %v\r\n", runtime.Version()),
+		":bar.example.com 374 nick :End of INFO list\r\n",
+	}, readLines(3))
+
+	writeAndFlush(client, "VERSION *.example.com\r\n")
+	assert.Equal(t, []string{
+		":bar.example.com 351 nick 0.0 bar.example.com :\r\n",
+		":bar.example.com 005 nick CASEMAPPING=rfc1459 MONITOR=100 NICKLEN=30 :are supported by this server\r\n",
+	}, readLines(2))
+
+	writeAndFlush(client, "TIME\r\n")
+	r, _ := client.ReadString('\n')
+	assert.True(t, strings.HasPrefix(r, ":bar.example.com 391 nick bar.example.com :"))
+	_, err := time.Parse(time.RFC1123, strings.TrimSuffix(strings.SplitN(r, " :", 2)[1], "\r\n"))
+	assert.Nil(t, err)
+
+	writeAndFlush(client, "TIME foo.example.com\r\n")
+	r, _ = client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 402 nick foo.example.com :No such server\r\n", r)
+
+	// Without any admin details configured
+	server = MakeServer("bar.example.com")
+	client, serverConn = makeTestConn()
+	newIrcConnection(server, serverConn)
+	writeAndFlush(client, "NICK nick\r\n")
+	writeAndFlush(client, "USER user 0 * :Joe Bloggs\r\n")
+	discardRegistration(client)
+
+	writeAndFlush(client, "ADMIN\r\n")
+	r, _ = client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 423 nick bar.example.com :No administrative info available\r\n", r)
+	assert.Zero(t, client.Reader.Buffered())
+}
+
+func TestMotd(t *testing.T) {
+	path := t.TempDir() + "/ircd.motd"
+	long := strings.Repeat("word ", 100)
+	os.WriteFile(path, []byte("Welcome!\r\n\n"+long+"\n"), 0600)
+
+	config := DefaultConfig("bar.example.com")
+	config.MotdFile = path
+	server := MakeServerFromConfig(config)
+
+	client, serverConn := makeTestConn()
+	newIrcConnection(server, serverConn)
+	writeAndFlush(client, "NICK nick\r\n")
+	writeAndFlush(client, "USER user 0 * :Joe Bloggs\r\n")
+
+	// Sent after LUSERS as part of registration
+	r := ""
+	for !strings.Contains(r, " 266 ") {
+		r, _ = client.ReadString('\n')
+	}
+
+	prefix := ":bar.example.com 372 nick :- "
+	width := 512 - len(prefix) - 2
+	firstLine := strings.TrimSuffix(long[:width+1], " ")
+	firstLine = firstLine[:strings.LastIndex(firstLine, " ")]
+	expected := []string{
+		":bar.example.com 375 nick :- bar.example.com Message of the day - \r\n",
+		prefix + "Welcome!\r\n",
+		prefix + "\r\n",
+		prefix + firstLine + "\r\n",
+		prefix + long[len(firstLine)+1:] + "\r\n",
+		":bar.example.com 376 nick :End of MOTD command\r\n",
+	}
+	for _, e := range expected {
+		r, _ = client.ReadString('\n')
+		assert.Equal(t, e, r)
+		assert.LessOrEqual(t, len(r), 512)
+	}
+
+	writeAndFlush(client, "MOTD\r\n")
+	discardResponse(client, uint(len(expected)))
+
+	// Changes are picked up by REHASH
+	os.WriteFile(path, []byte("Changed\n"), 0600)
+	server.configPath = t.TempDir() + "/ircd.yaml"
+	os.WriteFile(server.configPath, []byte(fmt.Sprintf("name: bar.example.com\nlisteners: [{address: \":6667\"}]\nmotd_file: %v\n", path)), 0600)
+	_, err := rehash(server)
+	assert.Nil(t, err)
+
+	writeAndFlush(client, "MOTD bar.example.com\r\n")
+	expected = []string{
+		":bar.example.com 375 nick :- bar.example.com Message of the day - \r\n",
+		prefix + "Changed\r\n",
+		":bar.example.com 376 nick :End of MOTD command\r\n",
+	}
+	for _, e := range expected {
+		r, _ = client.ReadString('\n')
+		assert.Equal(t, e, r)
+	}
+	assert.Zero(t, client.Reader.Buffered())
+}
+
+func TestWrapLine(t *testing.T) {
+	assert.Equal(t, []string{"short"}, wrapLine("short", 10))
+	assert.Equal(t, []string{"split at", "spaces"}, wrapLine("split at spaces", 10))
+	assert.Equal(t, []string{"abcde", "fghij"}, wrapLine("abcdefghij", 5))
+	// Multibyte characters are kept whole
+	assert.Equal(t, []string{"ab", "é", "é", "é"}, wrapLine("abééé", 3))
+}
+
+func TestSnomasks(t *testing.T) {
+	server := newTestOperServer([]string{"kill"})
+
+	var newTestConn = func(nick string) (client *bufio.ReadWriter) {
+		client, serverConn := makeTestConn()
+		newIrcConnection(server, serverConn)
+		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+		discardRegistration(client)
+
+		return
+	}
+
+	oper := newTestConn("oper")
+
+	// Only operators can get server notices
+	writeAndFlush(oper, "MODE oper +s\r\n")
+	r, _ := oper.ReadString('\n')
+	assert.Equal(t, "\r\n", r)
+
+	writeAndFlush(oper, "OPER admin hunter2\r\n")
+	discardResponse(oper, 2)
+	writeAndFlush(oper, "MODE oper +s +ckno\r\n")
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, ":oper MODE oper :+s\r\n", r)
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 008 oper +ckno :Server notice mask\r\n", r)
+
+	writeAndFlush(oper, "MODE oper +s -o\r\n")
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 008 oper +ckn :Server notice mask\r\n", r)
+
+	user := newTestConn("user")
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com NOTICE oper :*** Notice -- Client connecting: user (user@pipe)\r\n", r)
+
+	writeAndFlush(user, "NICK other\r\n")
+	discardResponse(user, 1)
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com NOTICE oper :*** Notice -- Nick change: From user to other [user@pipe]\r\n", r)
+
+	// Not subscribed any more
+	writeAndFlush(user, "OPER admin wrong\r\n")
+	discardResponse(user, 1)
+
+	writeAndFlush(oper, "KILL other :Spamming\r\n")
+	expected := []string{
+		":bar.example.com NOTICE oper :*** Notice -- Received KILL message for other. From oper (Spamming)\r\n",
+		":bar.example.com NOTICE oper :*** Notice -- Client exiting: other (user@pipe) [Killed (oper (Spamming))]\r\n",
+		"\r\n",
+	}
+	for _, e := range expected {
+		r, _ = oper.ReadString('\n')
+		assert.Equal(t, e, r)
+	}
+
+	// Losing operator status removes +s
+	writeAndFlush(oper, "MODE oper -o\r\n")
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, ":oper MODE oper :-os\r\n", r)
+	assert.Zero(t, oper.Reader.Buffered())
+}
+
+// Writes a self-signed certificate and its key as PEM files in dir
+func writeTestCertificate(t *testing.T, dir string, name string) (certificate tls.Certificate, files certificateFiles) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	files = certificateFiles{dir + "/" + name + ".crt", dir + "/" + name + ".key"}
+	os.WriteFile(files.certificate, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(files.key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	certificate, err = tls.LoadX509KeyPair(files.certificate, files.key)
+	assert.Nil(t, err)
+
+	return
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	_, serverFiles := writeTestCertificate(t, dir, "server")
+	clientCertificate, _ := writeTestCertificate(t, dir, "client")
+	sum := sha256.Sum256(clientCertificate.Certificate[0])
+	fingerprint := hex.EncodeToString(sum[:])
+
+	server := MakeServer("bar.example.com")
+	tlsConfig, err := server.certificates.tlsConfig(serverFiles)
+	assert.Nil(t, err)
+
+	var newTLSConn = func(certificates []tls.Certificate) (client *bufio.ReadWriter, conn *tls.Conn) {
+		clientConn, serverConn := net.Pipe()
+		clientConn.SetDeadline(time.Now().Add(time.Second))
+		conn = tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true, Certificates: certificates})
+		newIrcConnection(server, tls.Server(serverConn, tlsConfig))
+		client = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+		return
+	}
+	var register = func(client *bufio.ReadWriter, nick string) {
+		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+		discardRegistration(client)
+	}
+	var whois = func(client *bufio.ReadWriter, nick string, lines int) []string {
+		writeAndFlush(client, "WHOIS "+nick+"\r\n")
+		responses := []string{}
+		for range lines {
+			r, _ := client.ReadString('\n')
+			responses = append(responses, r)
+		}
+		return responses
+	}
+
+	secure, secureConn := newTLSConn([]tls.Certificate{clientCertificate})
+	register(secure, "secure")
+	firstCertificate := secureConn.ConnectionState().PeerCertificates[0]
+
+	writeAndFlush(secure, "MODE secure\r\n")
+	r, _ := secure.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 221 secure +Z\r\n", r)
+
+	// Users see their own fingerprint
+	assert.Equal(t, []string{
+		":bar.example.com 311 secure secure secure pipe :Joe Bloggs\r\n",
+		":bar.example.com 312 secure secure bar.example.com :Toy server\r\n",
+		":bar.example.com 671 secure secure :is using a secure connection\r\n",
+		":bar.example.com 276 secure secure :has client certificate fingerprint " + fingerprint + "\r\n",
+		":bar.example.com 318 secure secure :End of /WHOIS list\r\n",
+	}, whois(secure, "secure", 5))
+
+	// Other users don't
+	plain, plainConn := makeTestConn()
+	newIrcConnection(server, plainConn)
+	register(plain, "plain")
+	assert.Equal(t, []string{
+		":bar.example.com 311 plain secure secure pipe :Joe Bloggs\r\n",
+		":bar.example.com 312 plain secure bar.example.com :Toy server\r\n",
+		":bar.example.com 671 plain secure :is using a secure connection\r\n",
+		":bar.example.com 318 plain secure :End of /WHOIS list\r\n",
+	}, whois(plain, "secure", 4))
+	assert.Equal(t, []string{
+		":bar.example.com 311 secure plain plain pipe :Joe Bloggs\r\n",
+		":bar.example.com 312 secure plain bar.example.com :Toy server\r\n",
+		":bar.example.com 318 secure plain :End of /WHOIS list\r\n",
+	}, whois(secure, "plain", 3))
+	assert.Zero(t, secure.Reader.Buffered())
+	assert.Zero(t, plain.Reader.Buffered())
+
+	// New connections get the reloaded certificate, and broken files keep the old one
+	writeTestCertificate(t, dir, "server")
+	assert.Nil(t, server.certificates.reload())
+	reloaded, reloadedConn := newTLSConn(nil)
+	register(reloaded, "reloaded")
+	secondCertificate := reloadedConn.ConnectionState().PeerCertificates[0]
+	assert.False(t, firstCertificate.Equal(secondCertificate))
+
+	os.WriteFile(serverFiles.key, []byte("not a key"), 0600)
+	assert.NotNil(t, server.certificates.reload())
+	kept, keptConn := newTLSConn(nil)
+	register(kept, "kept")
+	assert.True(t, secondCertificate.Equal(keptConn.ConnectionState().PeerCertificates[0]))
+}
+
+func TestListeners(t *testing.T) {
+	server := MakeServer("bar.example.com")
+	server.resolver = fakeResolver{}
+
+	// Registers, then looks up the host the server sees
+	var whoisSelf = func(conn net.Conn, nick string) string {
+		conn.SetDeadline(time.Now().Add(time.Second))
+		client := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+		// Also skips the hostname lookup notices
+		discardRegistration(client)
+		writeAndFlush(client, "WHOIS "+nick+"\r\n")
+		r, _ := client.ReadString('\n')
+		discardResponse(client, 2)
+		return r
+	}
+	var listen = func(config ListenerConfig) listener {
+		l, err := openListener(config, server.certificates)
+		assert.Nil(t, err)
+		t.Cleanup(func() { l.Close() })
+		go acceptConnections(server, l)
+		return l
+	}
+
+	ipv4 := listen(ListenerConfig{Address: "127.0.0.1:0"})
+	conn, err := net.Dial("tcp", ipv4.Addr().String())
+	assert.Nil(t, err)
+	assert.Equal(t, ":bar.example.com 311 ipv4 ipv4 ipv4 127.0.0.1 :Joe Bloggs\r\n", whoisSelf(conn, "ipv4"))
+
+	socket := listen(ListenerConfig{Address: t.TempDir() + "/ircd.sock", Class: "bots"})
+	conn, err = net.Dial("unix", socket.Addr().String())
+	assert.Nil(t, err)
+	assert.Equal(t, ":bar.example.com 311 bot bot bot localhost :Joe Bloggs\r\n", whoisSelf(conn, "bot"))
+
+	// A socket still in use isn't taken over, but one left behind is replaced
+	_, err = openListener(ListenerConfig{Address: socket.Addr().String()}, server.certificates)
+	assert.EqualError(t, err, socket.Addr().String()+": another server is already listening")
+	stale, err := net.Listen("unix", t.TempDir()+"/stale.sock")
+	assert.Nil(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	listen(ListenerConfig{Address: stale.Addr().String()})
+
+	// The client's address comes from the PROXY header, IPv6 addresses starting with ':' get a '0' in front
+	proxy := listen(ListenerConfig{Address: "127.0.0.1:0", Proxy: true, ProxyFrom: []string{"127.0.0.0/8"}})
+	conn, err = net.Dial("tcp", proxy.Addr().String())
+	assert.Nil(t, err)
+	conn.Write([]byte("PROXY TCP6 ::1 ::1 56324 6667\r\n"))
+	assert.Equal(t, ":bar.example.com 311 ipv6 ipv6 ipv6 0::1 :Joe Bloggs\r\n", whoisSelf(conn, "ipv6"))
+
+	// Bad headers close the connection
+	conn, err = net.Dial("tcp", proxy.Addr().String())
+	assert.Nil(t, err)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("NICK guest\r\n"))
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+
+	// So do connections from anywhere other than the trusted proxies
+	untrusted := listen(ListenerConfig{Address: "127.0.0.1:0", Proxy: true, ProxyFrom: []string{"192.0.2.1"}})
+	conn, err = net.Dial("tcp", untrusted.Addr().String())
+	assert.Nil(t, err)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("PROXY TCP4 198.51.100.1 192.0.2.2 56324 6667\r\n"))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 6667", "192.0.2.1:56324"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 6667", "[2001:db8::1]:56324"},
+		{"PROXY UNKNOWN", "<nil>"},
+		{"PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535", "<nil>"},
+	}
+	for _, tt := range tests {
+		addr, err := parseProxyHeader(tt.header)
+		assert.Nil(t, err)
+		assert.Equal(t, tt.expected, fmt.Sprint(addr))
+	}
+
+	for _, header := range []string{"NICK guest", "PROXY TCP4 192.0.2.1 198.51.100.1 56324", "PROXY TCP4 nowhere 198.51.100.1 56324 6667", "PROXY UDP4 192.0.2.1 198.51.100.1 56324 6667"} {
+		_, err := parseProxyHeader(header)
+		assert.EqualError(t, err, fmt.Sprintf("invalid PROXY header %q", header))
+	}
+}
+
+// Serves PTR records from names and A and AAAA records from addrs.
+// Lookups of "slow" wait until they time out.
+type fakeResolver struct {
+	names map[string][]string
+	addrs map[string][]string
+}
+
+func (r fakeResolver) lookup(ctx context.Context, records map[string][]string, key string) ([]string, error) {
+	if key == "slow" || key == "192.0.2.99" {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	result, present := records[key]
+	if !present {
+		return nil, &net.DNSError{Err: "no such host", Name: key, IsNotFound: true}
+	}
+	return result, nil
+}
+
+func (r fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return r.lookup(ctx, r.names, addr)
+}
+
+func (r fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return r.lookup(ctx, r.addrs, host)
+}
+
+func TestHostnameLookup(t *testing.T) {
+	resolver := fakeResolver{
+		names: map[string][]string{
+			"192.0.2.1":   {"client.example.com."},
+			"192.0.2.2":   {"spoofed.example.com."},
+			"192.0.2.3":   {"bad name.example.com.", "ok.example.com."},
+			"2001:db8::1": {"v6.example.com."},
+		},
+		addrs: map[string][]string{
+			"client.example.com":  {"192.0.2.1"},
+			"spoofed.example.com": {"198.51.100.1"},
+			"ok.example.com":      {"198.51.100.2", "192.0.2.3"},
+			"v6.example.com":      {"2001:db8:0::1"},
+		},
+	}
+
+	tests := []struct {
+		ip       string
+		expected string
+		found    bool
+	}{
+		{"192.0.2.1", "client.example.com", true},
+		{"192.0.2.2", "", false},
+		{"192.0.2.3", "ok.example.com", true},
+		{"2001:db8::1", "v6.example.com", true},
+		{"192.0.2.4", "", false},
+		{"192.0.2.99", "", false},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		name, found := lookupHostname(ctx, resolver, tt.ip)
+		cancel()
+		assert.Equal(t, tt.expected, name, tt.ip)
+		assert.Equal(t, tt.found, found, tt.ip)
+	}
+
+	assert.True(t, isValidHostname("irc-1.example.com"))
+	assert.False(t, isValidHostname("192.0.2.1"))
+	assert.False(t, isValidHostname("-.example.com"))
+	assert.False(t, isValidHostname("a..example.com"))
+	assert.False(t, isValidHostname(strings.Repeat("a", 64)))
+
+	// Clients are told about the lookup, and the hostname is used in their prefix
+	server := MakeServer("bar.example.com")
+	server.resolver = resolver
+	var newTestConn = func(ip string) (client *bufio.ReadWriter) {
+		client, serverConn := makeTestConn()
+		newIrcConnection(server, proxiedConn{serverConn, &net.TCPAddr{IP: net.ParseIP(ip), Port: 56324}})
+		return
+	}
+
+	client := newTestConn("192.0.2.1")
+	r, _ := client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com NOTICE * :*** Looking up your hostname...\r\n", r)
+	r, _ = client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com NOTICE * :*** Found your hostname\r\n", r)
+	writeAndFlush(client, "NICK client\r\n")
+	writeAndFlush(client, "USER client 0 * :Joe Bloggs\r\n")
+	r, _ = client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 001 client :Welcome to the Internet Relay Network client!client@client.example.com\r\n", r)
+
+	spoofed := newTestConn("192.0.2.2")
+	r, _ = spoofed.ReadString('\n')
+	assert.Equal(t, ":bar.example.com NOTICE * :*** Looking up your hostname...\r\n", r)
+	r, _ = spoofed.ReadString('\n')
+	assert.Equal(t, ":bar.example.com NOTICE * :*** Couldn't look up your hostname\r\n", r)
+	writeAndFlush(spoofed, "NICK spoofed\r\n")
+	writeAndFlush(spoofed, "USER spoofed 0 * :Joe Bloggs\r\n")
+	r, _ = spoofed.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 001 spoofed :Welcome to the Internet Relay Network spoofed!spoofed@192.0.2.2\r\n", r)
+}
+
+func TestResolvedHostsMatchByIP(t *testing.T) {
+	config := DefaultConfig("bar.example.com")
+	config.Opers = []OperConfig{{"admin", hashPassword("hunter2"), []string{"*@127.0.0.1"}, "staff"}}
+	config.OperClasses = []OperClassConfig{{"staff", []string{"kline"}}}
+	config.BanFile = t.TempDir() + "/bans.json"
+	server := MakeServerFromConfig(config)
+	server.resolver = fakeResolver{
+		names: map[string][]string{"127.0.0.1": {"localhost."}, "192.0.2.1": {"client.example.com."}},
+		addrs: map[string][]string{"localhost": {"127.0.0.1"}, "client.example.com": {"192.0.2.1"}},
+	}
+
+	var newTestConn = func(nick string, ip string) (client *bufio.ReadWriter) {
+		client, serverConn := makeTestConn()
+		newIrcConnection(server, proxiedConn{serverConn, &net.TCPAddr{IP: net.ParseIP(ip), Port: 6667}})
+		// Hostname lookup notices
+		discardResponse(client, 2)
+		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+		return
+	}
+
+	// Oper hosts match the IP even though it resolved to localhost
+	oper := newTestConn("oper", "127.0.0.1")
+	r, _ := oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 001 oper :Welcome to the Internet Relay Network oper!oper@localhost\r\n", r)
+	discardRegistration(oper)
+	writeAndFlush(oper, "OPER admin hunter2\r\n")
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 381 oper :You are now an IRC operator\r\n", r)
+	discardResponse(oper, 1)
+
+	// So do K-lines
+	victim := newTestConn("victim", "192.0.2.1")
+	discardRegistration(victim)
+	writeAndFlush(oper, "KLINE 60 *@192.0.2.1 :Spamming\r\n")
+	r, _ = victim.ReadString('\n')
+	assert.Equal(t, ":bar.example.com ERROR :Closing Link: client.example.com K-lined (Spamming)\r\n", r)
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com NOTICE oper :Added K-line for [*@192.0.2.1]\r\n", r)
+
+	victim = newTestConn("victim", "192.0.2.1")
+	r, _ = victim.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 465 * :You are banned from this server- Spamming\r\n", r)
+	r, _ = victim.ReadString('\n')
+	assert.Equal(t, ":bar.example.com ERROR :Closing Link: client.example.com K-lined (Spamming)\r\n", r)
+	_, err := victim.ReadString('\n')
+	assert.NotNil(t, err)
+
+	// Nothing sent after the rejection is handled
+	state := connectionState{user: "victim", host: "client.example.com", ip: "192.0.2.1", sendq: newSendQueue(maxLineLength), quit: make(chan bool, 1)}
+	tryRegister(server, &state, "again")
+	assert.Equal(t, phaseClosed, state.phase)
+}
+
+func TestCloakHost(t *testing.T) {
+	const key = "0123456789abcdef"
+
+	// Addresses on the same network share the end of the cloak
+	a := strings.Split(cloakHost(key, "192.0.2.1"), ".")
+	b := strings.Split(cloakHost(key, "192.0.2.2"), ".")
+	c := strings.Split(cloakHost(key, "192.0.3.1"), ".")
+	assert.Len(t, a, 4)
+	assert.Equal(t, "IP", a[3])
+	assert.NotEqual(t, a[0], b[0])
+	assert.Equal(t, a[1:], b[1:])
+	assert.NotEqual(t, a[1], c[1])
+	assert.Equal(t, a[2:], c[2:])
+
+	v6 := strings.Split(cloakHost(key, "2001:db8::1"), ":")
+	sameNetwork := strings.Split(cloakHost(key, "2001:db8::2"), ":")
+	assert.Len(t, v6, 4)
+	assert.Equal(t, v6[1:], sameNetwork[1:])
+	assert.Equal(t, cloakHost(key, "::1"), cloakHost(key, "0::1"))
+
+	host := strings.Split(cloakHost(key, "client.example.com"), ".")
+	assert.Equal(t, []string{"example", "com"}, host[1:])
+	assert.Regexp(t, "^[0-9A-F]{8}$", host[0])
+
+	// The same host always gets the same cloak, unless the key changes
+	assert.Equal(t, cloakHost(key, "192.0.2.1"), cloakHost(key, "192.0.2.1"))
+	assert.NotEqual(t, cloakHost(key, "192.0.2.1"), cloakHost("fedcba9876543210", "192.0.2.1"))
+}
+
+func TestCloaking(t *testing.T) {
+	config := DefaultConfig("bar.example.com")
+	config.CloakKey = "0123456789abcdef"
+	config.Opers = []OperConfig{{"admin", hashPassword("hunter2"), []string{"*@pipe"}, "staff"}}
+	config.OperClasses = []OperClassConfig{{"staff", []string{}}}
+	server := MakeServerFromConfig(config)
+	cloak := cloakHost(config.CloakKey, "pipe")
+
+	var newTestConn = func(nick string) (client *bufio.ReadWriter) {
+		client, serverConn := makeTestConn()
+		newIrcConnection(server, serverConn)
+		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+		r, _ := client.ReadString('\n')
+		assert.Equal(t, fmt.Sprintf(":bar.example.com 001 %v :Welcome to the Internet Relay Network %v!%v@%v\r\n", nick, nick, nick, cloak), r)
+		discardRegistration(client)
+		return
+	}
+	var whois = func(client *bufio.ReadWriter, nick string, lines int) []string {
+		writeAndFlush(client, "WHOIS "+nick+"\r\n")
+		responses := []string{}
+		for range lines {
+			r, _ := client.ReadString('\n')
+			responses = append(responses, r)
+		}
+		return responses
+	}
+
+	guest := newTestConn("guest")
+	writeAndFlush(guest, "MODE guest\r\n")
+	r, _ := guest.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 221 guest +x\r\n", r)
+
+	// Other users only see the cloak
+	other := newTestConn("other")
+	assert.Equal(t, []string{
+		":bar.example.com 311 other guest guest " + cloak + " :Joe Bloggs\r\n",
+		":bar.example.com 312 other guest bar.example.com :Toy server\r\n",
+		":bar.example.com 318 other guest :End of /WHOIS list\r\n",
+	}, whois(other, "guest", 3))
+
+	// Operators are matched against the real host, and can see it
+	oper := newTestConn("oper")
+	writeAndFlush(oper, "OPER admin hunter2\r\n")
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 381 oper :You are now an IRC operator\r\n", r)
+	discardResponse(oper, 1)
+	assert.Equal(t, []string{
+		":bar.example.com 311 oper guest guest " + cloak + " :Joe Bloggs\r\n",
+		":bar.example.com 312 oper guest bar.example.com :Toy server\r\n",
+		":bar.example.com 378 oper guest :is connecting from *@pipe\r\n",
+		":bar.example.com 318 oper guest :End of /WHOIS list\r\n",
+	}, whois(oper, "guest", 4))
+
+	// Users can turn cloaking off and on again
+	writeAndFlush(guest, "MODE guest -x\r\n")
+	r, _ = guest.ReadString('\n')
+	assert.Equal(t, ":guest MODE guest :-x\r\n", r)
+	assert.Equal(t, ":bar.example.com 311 other guest guest pipe :Joe Bloggs\r\n", whois(other, "guest", 3)[0])
+
+	writeAndFlush(guest, "MODE guest +x\r\n")
+	r, _ = guest.ReadString('\n')
+	assert.Equal(t, ":guest MODE guest :+x\r\n", r)
+	assert.Equal(t, ":bar.example.com 311 other guest guest "+cloak+" :Joe Bloggs\r\n", whois(other, "guest", 3)[0])
+	assert.Zero(t, guest.Reader.Buffered())
+	assert.Zero(t, other.Reader.Buffered())
+}
+
+func TestCloakedPrivmsg(t *testing.T) {
+	config := DefaultConfig("bar.example.com")
+	config.CloakKey = "0123456789abcdef"
+	server := MakeServerFromConfig(config)
+	cloak := cloakHost(config.CloakKey, "pipe")
+
+	var newTestConn = func(nick string) (client *bufio.ReadWriter) {
+		client, serverConn := makeTestConn()
+		newIrcConnection(server, serverConn)
+		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+		discardRegistration(client)
+		writeAndFlush(client, "JOIN #test\r\n")
+		discardResponse(client, 4)
+		return
+	}
+
+	sender := newTestConn("sender")
+	receiver := newTestConn("receiver")
+	discardResponse(sender, 1)
+
+	// Channel members and DM recipients only see the cloak
+	writeAndFlush(sender, "PRIVMSG #test :Hello\r\n")
+	r, _ := receiver.ReadString('\n')
+	assert.Equal(t, ":sender!sender@"+cloak+" PRIVMSG #test :Hello\r\n", r)
+	discardResponse(sender, 2)
+
+	writeAndFlush(sender, "NOTICE receiver :Hello\r\n")
+	r, _ = receiver.ReadString('\n')
+	assert.Equal(t, ":sender!sender@"+cloak+" NOTICE receiver :Hello\r\n", r)
+	discardResponse(sender, 1)
+	assert.Zero(t, sender.Reader.Buffered())
+	assert.Zero(t, receiver.Reader.Buffered())
+}
+
+func TestKlineCloakedHost(t *testing.T) {
+	config := DefaultConfig("bar.example.com")
+	config.CloakKey = "0123456789abcdef"
+	config.Opers = []OperConfig{{"admin", hashPassword("hunter2"), []string{"*@*"}, "staff"}}
+	config.OperClasses = []OperClassConfig{{"staff", []string{"kline"}}}
+	config.BanFile = t.TempDir() + "/bans.json"
+	server := MakeServerFromConfig(config)
+	server.resolver = fakeResolver{}
+
+	var newTestConn = func(nick string, ip string) (client *bufio.ReadWriter) {
+		client, serverConn := makeTestConn()
+		newIrcConnection(server, proxiedConn{serverConn, &net.TCPAddr{IP: net.ParseIP(ip), Port: 6667}})
+		// Hostname lookup notices
+		discardResponse(client, 2)
+		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+		return
+	}
+
+	oper := newTestConn("oper", "198.51.100.1")
+	discardRegistration(oper)
+	writeAndFlush(oper, "OPER admin hunter2\r\n")
+	discardResponse(oper, 2)
+	victim := newTestConn("victim", "192.0.2.1")
+	discardRegistration(victim)
+
+	// Operators only see the cloak, so ban the network part of it
+	cloak := strings.Split(cloakHost(config.CloakKey, "192.0.2.1"), ".")
+	mask := "*@*." + strings.Join(cloak[1:], ".")
+	writeAndFlush(oper, "KLINE 60 "+mask+" :Spamming\r\n")
+	r, _ := victim.ReadString('\n')
+	assert.Equal(t, ":bar.example.com ERROR :Closing Link: 192.0.2.1 K-lined (Spamming)\r\n", r)
+	r, _ = oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com NOTICE oper :Added K-line for ["+mask+"]\r\n", r)
+
+	// New connections from the same network are rejected at registration
+	victim = newTestConn("victim", "192.0.2.2")
+	r, _ = victim.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 465 * :You are banned from this server- Spamming\r\n", r)
+
+	other := newTestConn("other", "198.51.100.2")
+	r, _ = other.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 001 other :Welcome to the Internet Relay Network other!other@"+cloakHost(config.CloakKey, "198.51.100.2")+"\r\n", r)
+}
+
+func TestPingTimeout(t *testing.T) {
+	config := DefaultConfig("bar.example.com")
+	config.Classes = []ClassConfig{
+		{Name: "default", PingFrequency: 50 * time.Millisecond, PingTimeout: 50 * time.Millisecond},
+		{Name: "patient"},
+	}
+	server := MakeServerFromConfig(config)
+
+	var newTestConn = func(nick string, class string) (client *bufio.ReadWriter) {
+		client, serverConn := makeTestConn()
+		newClassConnection(server, serverConn, class)
+		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+		discardRegistration(client)
+		writeAndFlush(client, "JOIN #test\r\n")
+		discardResponse(client, 4)
+		return
+	}
+	var readPing = func(client *bufio.ReadWriter) string {
+		r, _ := client.ReadString('\n')
+		assert.Regexp(t, "^PING :[0-9a-f]{8}\r\n$", r)
+		return strings.TrimSuffix(strings.TrimPrefix(r, "PING :"), "\r\n")
+	}
+
+	// Uses the default settings, so isn't pinged during the test
+	watcher := newTestConn("watcher", "patient")
+	idle := newTestConn("idle", "default")
+	r, _ := watcher.ReadString('\n')
+	assert.Equal(t, ":idle!idle@pipe JOIN #test\r\n", r)
+	token := readPing(idle)
+
+	// Answering keeps the connection open
+	writeAndFlush(idle, "PONG bar.example.com :"+token+"\r\n")
+	r, _ = idle.ReadString('\n')
+	assert.Equal(t, "\r\n", r)
+	token = readPing(idle)
+
+	// Any other command counts too, but a PONG with the wrong token doesn't
+	writeAndFlush(idle, "PING :still here\r\n")
+	r, _ = idle.ReadString('\n')
+	assert.Equal(t, ":bar.example.com PONG bar.example.com still here\r\n", r)
+	readPing(idle)
+	writeAndFlush(idle, "PONG :"+token+"\r\n")
+	r, _ = idle.ReadString('\n')
+	assert.Equal(t, "\r\n", r)
+
+	r, _ = idle.ReadString('\n')
+	assert.Equal(t, ":bar.example.com ERROR :Closing Link: pipe Ping timeout: 0 seconds\r\n", r)
+	_, err := idle.ReadString('\n')
+	assert.NotNil(t, err)
+
+	r, _ = watcher.ReadString('\n')
+	assert.Equal(t, ":idle!idle@pipe QUIT :Ping timeout: 0 seconds\r\n", r)
+	assert.Zero(t, watcher.Reader.Buffered())
+}
+
+func TestRegistrationTimeout(t *testing.T) {
+	config := DefaultConfig("bar.example.com")
+	config.Classes = []ClassConfig{{Name: "default", RegistrationTimeout: 50 * time.Millisecond}}
+	server := MakeServerFromConfig(config)
+
+	// Partial registration isn't answered
+	client, serverConn := makeTestConn()
+	newIrcConnection(server, serverConn)
+	writeAndFlush(client, "NICK guest\r\n")
+	r, _ := client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com ERROR :Closing Link: pipe Registration timed out\r\n", r)
+	_, err := client.ReadString('\n')
+	assert.NotNil(t, err)
+
+	// Registered connections stay open
+	client, serverConn = makeTestConn()
+	newIrcConnection(server, serverConn)
+	writeAndFlush(client, "NICK guest\r\n")
+	writeAndFlush(client, "USER guest 0 * :Joe Bloggs\r\n")
+	discardRegistration(client)
+	time.Sleep(100 * time.Millisecond)
+	writeAndFlush(client, "PING :still here\r\n")
+	r, _ = client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com PONG bar.example.com still here\r\n", r)
+}
+
+func TestPass(t *testing.T) {
+	config := DefaultConfig("bar.example.com")
+	config.Classes = []ClassConfig{{Name: "default", Password: hashPassword("letmein")}}
+	server := MakeServerFromConfig(config)
+
+	// PASS can come at any point before registration ends
+	client, serverConn := makeTestConn()
+	newIrcConnection(server, serverConn)
+	writeAndFlush(client, "NICK guest\r\n")
+	writeAndFlush(client, "PASS letmein\r\n")
+	writeAndFlush(client, "USER guest 0 * :Joe Bloggs\r\n")
+	r, _ := client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 001 guest :Welcome to the Internet Relay Network guest!guest@pipe\r\n", r)
+	discardRegistration(client)
+
+	writeAndFlush(client, "PASS letmein\r\n")
+	r, _ = client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 462 guest :Unauthorized command (already registered)\r\n", r)
+
+	for _, pass := range []string{"", "PASS wrong\r\n"} {
+		client, serverConn = makeTestConn()
+		newIrcConnection(server, serverConn)
+		writeAndFlush(client, pass+"NICK other\r\n")
+		// Nothing after a failed registration is handled
+		writeAndFlush(client, "USER other 0 * :Joe Bloggs\r\nPASS letmein\r\nNICK other\r\n")
+		r, _ = client.ReadString('\n')
+		assert.Equal(t, ":bar.example.com 464 other :Password incorrect\r\n", r)
+		r, _ = client.ReadString('\n')
+		assert.Equal(t, ":bar.example.com ERROR :Closing Link: pipe Bad password\r\n", r)
+		_, err := client.ReadString('\n')
+		assert.NotNil(t, err)
+	}
+}
+
+func TestWebirc(t *testing.T) {
+	config := DefaultConfig("bar.example.com")
+	config.Webirc = []WebircConfig{{Name: "web", Password: hashPassword("gateway"), Hosts: []string{"192.0.2.0/24"}}}
+	server := MakeServerFromConfig(config)
+	server.resolver = fakeResolver{}
+
+	var newTestConn = func(ip string) (client *bufio.ReadWriter) {
+		client, serverConn := makeTestConn()
+		newIrcConnection(server, proxiedConn{serverConn, &net.TCPAddr{IP: net.ParseIP(ip), Port: 6667}})
+		// Hostname lookup notices
+		discardResponse(client, 2)
+		return
+	}
+	var whoisSelf = func(client *bufio.ReadWriter, nick string) []string {
+		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+		discardRegistration(client)
+		writeAndFlush(client, "WHOIS "+nick+"\r\n")
+		responses := []string{}
+		for {
+			r, _ := client.ReadString('\n')
+			responses = append(responses, r)
+			if strings.Contains(r, " 318 ") || len(r) == 0 {
+				return responses
+			}
+		}
+	}
+
+	client := newTestConn("192.0.2.10")
+	writeAndFlush(client, "WEBIRC gateway web user.example.com 198.51.100.7 :secure\r\n")
+	assert.Equal(t, []string{
+		":bar.example.com 311 guest guest guest user.example.com :Joe Bloggs\r\n",
+		":bar.example.com 312 guest guest bar.example.com :Toy server\r\n",
+		":bar.example.com 671 guest guest :is using a secure connection\r\n",
+		":bar.example.com 318 guest guest :End of /WHOIS list\r\n",
+	}, whoisSelf(client, "guest"))
+
+	// Hostnames which can't be used are replaced with the IP
+	client = newTestConn("192.0.2.10")
+	writeAndFlush(client, "WEBIRC gateway web bad_host 2001:db8::1\r\n")
+	assert.Equal(t, ":bar.example.com 311 ipv6 ipv6 ipv6 2001:db8::1 :Joe Bloggs\r\n", whoisSelf(client, "ipv6")[0])
+
+	tests := []struct {
+		name  string
+		ip    string
+		input string
+	}{
+		{"wrong password", "192.0.2.10", "WEBIRC wrong web host 198.51.100.7\r\n"},
+		{"unknown gateway address", "198.51.100.1", "WEBIRC gateway web host 198.51.100.7\r\n"},
+		{"invalid IP", "192.0.2.10", "WEBIRC gateway web host 198.51.100\r\n"},
+		{"not enough parameters", "192.0.2.10", "WEBIRC gateway web host\r\n"},
+		{"after registration has begun", "192.0.2.10", "CAP LS\r\nWEBIRC gateway web host 198.51.100.7\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestConn(tt.ip)
+			writeAndFlush(client, tt.input)
+			if strings.HasPrefix(tt.input, "CAP") {
+				r, _ := client.ReadString('\n')
+				assert.Equal(t, ":bar.example.com CAP * LS :chghost sasl setname\r\n", r)
+			}
+			r, _ := client.ReadString('\n')
+			assert.Equal(t, fmt.Sprintf(":bar.example.com ERROR :Closing Link: %v Invalid WEBIRC command\r\n", tt.ip), r)
+			_, err := client.ReadString('\n')
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestSasl(t *testing.T) {
+	dir := t.TempDir()
+	_, serverFiles := writeTestCertificate(t, dir, "server")
+	clientCertificate, _ := writeTestCertificate(t, dir, "client")
+	sum := sha256.Sum256(clientCertificate.Certificate[0])
+
+	config := DefaultConfig("bar.example.com")
+	config.Accounts = []AccountConfig{
+		{Name: "alice", Password: hashPassword("hunter2")},
+		{Name: "bob", Certfp: hex.EncodeToString(sum[:])},
+	}
+	server := MakeServerFromConfig(config)
+
+	var newTestConn = func(nick string, caps string) (client *bufio.ReadWriter) {
+		client, serverConn := makeTestConn()
+		newIrcConnection(server, serverConn)
+		writeAndFlush(client, "CAP REQ :"+caps+"\r\n")
+		discardResponse(client, 1)
+		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+		return
+	}
+	var authenticate = func(client *bufio.ReadWriter, mechanism string, message string, lines int) []string {
+		writeAndFlush(client, "AUTHENTICATE "+mechanism+"\r\n")
+		r, _ := client.ReadString('\n')
+		assert.Equal(t, "AUTHENTICATE +\r\n", r)
+		writeAndFlush(client, "AUTHENTICATE "+message+"\r\n")
+		responses := []string{}
+		for range lines {
+			r, _ := client.ReadString('\n')
+			responses = append(responses, r)
+		}
+		return responses
+	}
+	var plain = func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	client := newTestConn("guest", "sasl")
+	assert.Equal(t, []string{":bar.example.com 904 guest :SASL authentication failed\r\n"}, authenticate(client, "PLAIN", plain("\x00alice\x00wrong"), 1))
+	assert.Equal(t, []string{":bar.example.com 904 guest :SASL authentication failed\r\n"}, authenticate(client, "PLAIN", plain("bob\x00alice\x00hunter2"), 1))
+	assert.Equal(t, []string{":bar.example.com 906 guest :SASL authentication aborted\r\n"}, authenticate(client, "PLAIN", "*", 1))
+	// Without a client certificate
+	assert.Equal(t, []string{":bar.example.com 904 guest :SASL authentication failed\r\n"}, authenticate(client, "EXTERNAL", "+", 1))
+	assert.Equal(t, []string{
+		":bar.example.com 900 guest guest!guest@pipe alice :You are now logged in as alice\r\n",
+		":bar.example.com 903 guest :SASL authentication successful\r\n",
+	}, authenticate(client, "PLAIN", plain("alice\x00alice\x00hunter2"), 2))
+
+	writeAndFlush(client, "AUTHENTICATE PLAIN\r\n")
+	r, _ := client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 907 guest :You have already authenticated using SASL\r\n", r)
+
+	writeAndFlush(client, "CAP END\r\n")
+	discardRegistration(client)
+	writeAndFlush(client, "WHOIS guest\r\n")
+	discardResponse(client, 2)
+	r, _ = client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com 330 guest guest alice :is logged in as\r\n", r)
+
+	// Registration waits for the exchange to finish
+	client = newTestConn("waiting", "sasl")
+	writeAndFlush(client, "AUTHENTICATE FOO\r\n")
+	assert.Equal(t, []string{
+		":bar.example.com 908 waiting PLAIN,EXTERNAL :are available SASL mechanisms\r\n",
+		":bar.example.com 904 waiting :SASL authentication failed\r\n",
+	}, []string{readLine(client), readLine(client)})
+	chunk := strings.Repeat("A", 400)
+	writeAndFlush(client, "AUTHENTICATE PLAIN\r\n")
+	discardResponse(client, 1)
+	for range 4 {
+		writeAndFlush(client, "AUTHENTICATE "+chunk+"\r\n")
+	}
+	writeAndFlush(client, "CAP END\r\n")
+	writeAndFlush(client, "AUTHENTICATE "+chunk+"\r\n")
+	assert.Equal(t, ":bar.example.com 905 waiting :SASL message too long\r\n", readLine(client))
+	assert.Equal(t, ":bar.example.com 001 waiting :Welcome to the Internet Relay Network waiting!waiting@pipe\r\n", readLine(client))
+	discardRegistration(client)
+
+	// SASL has to be requested first
+	client = newTestConn("nosasl", "setname")
+	writeAndFlush(client, "AUTHENTICATE PLAIN\r\n")
+	assert.Equal(t, ":bar.example.com 904 nosasl :SASL authentication failed\r\n", readLine(client))
+
+	// EXTERNAL logs in with the client certificate
+	tlsConfig, err := server.certificates.tlsConfig(serverFiles)
+	assert.Nil(t, err)
+	clientConn, serverConn := net.Pipe()
+	clientConn.SetDeadline(time.Now().Add(time.Second))
+	conn := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{clientCertificate}})
+	newIrcConnection(server, tls.Server(serverConn, tlsConfig))
+	client = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	writeAndFlush(client, "CAP REQ :sasl\r\n")
+	discardResponse(client, 1)
+	writeAndFlush(client, "NICK secure\r\n")
+	assert.Equal(t, []string{
+		":bar.example.com 900 secure secure!*@pipe bob :You are now logged in as bob\r\n",
+		":bar.example.com 903 secure :SASL authentication successful\r\n",
+	}, authenticate(client, "EXTERNAL", "+", 2))
+}
+
+func readLine(client *bufio.ReadWriter) string {
+	r, _ := client.ReadString('\n')
+	return r
+}
+
+func TestFloodControl(t *testing.T) {
+	assert.Equal(t, 0, commandPenalty("PONG"))
+	assert.Equal(t, 2, commandPenalty("JOIN"))
+	assert.Equal(t, 1, commandPenalty("PRIVMSG"))
+
+	// The burst is handled at once, then one message every interval
+	now := time.Now()
+	flood := newFloodControl(ClassConfig{FloodBurst: 2, FloodInterval: time.Second, FloodLimit: 3})
+	assert.True(t, flood.readyAt(now).IsZero())
+	assert.True(t, flood.push("PRIVMSG a :1\r\n"))
+	assert.True(t, flood.push("PRIVMSG a :2\r\n"))
+	assert.True(t, flood.push("JOIN #a\r\n"))
+	assert.False(t, flood.push("PRIVMSG a :3\r\n"))
+	assert.Equal(t, now.Add(-time.Second), flood.readyAt(now))
+	assert.Equal(t, "PRIVMSG a :1\r\n", flood.pop(now, false))
+	assert.Equal(t, now, flood.readyAt(now))
+	assert.Equal(t, "PRIVMSG a :2\r\n", flood.pop(now, false))
+	assert.Equal(t, now.Add(2*time.Second), flood.readyAt(now))
+	// Exempt messages don't add to the penalty
+	assert.Equal(t, "JOIN #a\r\n", flood.pop(now, true))
+	assert.Equal(t, now.Add(time.Second), flood.readyAt(now))
+}
+
+func TestFlood(t *testing.T) {
+	config := DefaultConfig("bar.example.com")
+	config.Opers = []OperConfig{{"admin", hashPassword("hunter2"), []string{"*@*"}, "staff"}}
+	config.OperClasses = []OperClassConfig{{"staff", []string{}}}
+	config.Classes = []ClassConfig{
+		// Held back messages are never handled during the test
+		{Name: "default", FloodBurst: 8, FloodInterval: time.Hour, FloodLimit: 10},
+		{Name: "slow", FloodBurst: 4, FloodInterval: 50 * time.Millisecond},
+		{Name: "bots", FloodBurst: 8, FloodInterval: time.Hour, FloodExempt: true},
+	}
+	server := MakeServerFromConfig(config)
+
+	var newTestConn = func(nick string, class string) (client *bufio.ReadWriter) {
+		client, serverConn := makeTestConn()
+		newClassConnection(server, serverConn, class)
+		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+		discardRegistration(client)
+		return
+	}
+	var ping = func(client *bufio.ReadWriter, count int) []string {
+		writeAndFlush(client, strings.Repeat("PING :flood\r\n", count))
+		responses := []string{}
+		for range count {
+			r, err := client.ReadString('\n')
+			if err != nil {
+				break
+			}
+			responses = append(responses, r)
+		}
+		return responses
+	}
+	var pongs = func(count int) []string {
+		return strings.SplitAfter(strings.Repeat(":bar.example.com PONG bar.example.com flood\r\n", count), "\r\n")[:count]
+	}
+
+	oper := newTestConn("oper", "default")
+	writeAndFlush(oper, "OPER admin hunter2\r\n")
+	discardResponse(oper, 2)
+	writeAndFlush(oper, "MODE oper +s +f\r\n")
+	discardResponse(oper, 2)
+
+	// Messages after the burst are delayed
+	slow := newTestConn("slow", "slow")
+	start := time.Now()
+	assert.Equal(t, pongs(10), ping(slow, 10))
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+
+	// Opers and exempt classes aren't held back
+	assert.Equal(t, pongs(20), ping(oper, 20))
+	bot := newTestConn("bot", "bots")
+	assert.Equal(t, pongs(20), ping(bot, 20))
+
+	// NICK and USER used 3 of the burst, and the rest waits until there are too many messages
+	flooder := newTestConn("flooder", "default")
+	assert.Equal(t, append(pongs(5),
+		":bar.example.com ERROR :Closing Link: pipe Excess Flood\r\n",
+	), ping(flooder, 20))
+
+	r, _ := oper.ReadString('\n')
+	assert.Equal(t, ":bar.example.com NOTICE oper :*** Notice -- Excess Flood from flooder (flooder@pipe)\r\n", r)
+	assert.Zero(t, oper.Reader.Buffered())
+}
+
+func TestLineTooLong(t *testing.T) {
+	server := MakeServer("bar.example.com")
+	client, serverConn := makeTestConn()
+	newIrcConnection(server, serverConn)
+	writeAndFlush(client, "NICK guest\r\n")
+	writeAndFlush(client, "USER guest 0 * :Joe Bloggs\r\n")
+	discardRegistration(client)
+
+	// Lines of up to maxLineLength are fine
+	writeAndFlush(client, "PING :"+strings.Repeat("a", maxLineLength-len("PING :\r\n"))+"\r\n")
+	r, _ := client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com PONG bar.example.com "+strings.Repeat("a", maxLineLength-len("PING :\r\n"))+"\r\n", r)
+
+	// The server stops reading once a line without a newline is too long, so write from another goroutine
+	go writeAndFlush(client, "PRIVMSG guest :"+strings.Repeat("a", 4*maxLineLength))
+	r, _ = client.ReadString('\n')
+	assert.Equal(t, ":bar.example.com ERROR :Closing Link: pipe Line too long\r\n", r)
+	_, err := client.ReadString('\n')
+	assert.NotNil(t, err)
+}
+
+func TestSendQueue(t *testing.T) {
+	sendq := newSendQueue(10)
+	sendq.send("12345")
+	sendq.send("6789")
+	assert.Equal(t, 9, sendq.length())
+	assert.Equal(t, []string{"12345", "6789"}, sendq.take())
+	assert.Zero(t, sendq.length())
+
+	// Going over the limit drops everything waiting, and anything sent after
+	sendq.send("123456")
+	sendq.send("78901")
+	sendq.send("2")
+	assert.Empty(t, sendq.take())
+	select {
+	case <-sendq.full:
+	default:
+		assert.Fail(t, "full was not closed")
+	}
+}
+
+func TestSlowClient(t *testing.T) {
+	config := DefaultConfig("bar.example.com")
+	config.Classes = []ClassConfig{{Name: "small", SendQ: 1024}}
+	server := MakeServerFromConfig(config)
+
+	var newTestConn = func(nick string, class string) (client *bufio.ReadWriter) {
+		client, serverConn := makeTestConn()
+		newClassConnection(server, serverConn, class)
+		writeAndFlush(client, fmt.Sprintf("NICK %v\r\n", nick))
+		writeAndFlush(client, fmt.Sprintf("USER %v 0 * :Joe Bloggs\r\n", nick))
+		discardRegistration(client)
+		writeAndFlush(client, "JOIN #test\r\n")
+		discardResponse(client, 4)
+		return
+	}
+
+	slow := newTestConn("slow", "small")
+	sender := newTestConn("sender", "default")
+	discardResponse(slow, 1)
+
+	// slow stops reading, but the server carries on
+	message := strings.Repeat("a", 150)
+	quits := []string{}
+	for range 12 {
+		writeAndFlush(sender, "PRIVMSG #test :"+message+"\r\n")
+		for {
+			r, _ := sender.ReadString('\n')
+			if r == "\r\n" {
+				break
+			}
+			if strings.Contains(r, " QUIT ") {
+				quits = append(quits, r)
+			} else {
+				assert.Equal(t, ":sender!sender@pipe PRIVMSG #test :"+message+"\r\n", r)
+			}
+		}
+	}
+	// slow's connection may not have noticed yet
+	if len(quits) == 0 {
+		r, _ := sender.ReadString('\n')
+		quits = append(quits, r)
+	}
+	assert.Equal(t, []string{":slow!slow@pipe QUIT :Max SendQ exceeded\r\n"}, quits)
+	assert.Zero(t, sender.Reader.Buffered())
+
+	// Only the messages the writer had already taken arrive
+	for {
+		r, err := slow.ReadString('\n')
+		if err != nil {
+			break
+		}
+		assert.Equal(t, ":sender!sender@pipe PRIVMSG #test :"+message+"\r\n", r)
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+	config := DefaultConfig("bar.example.com")
+	config.Limits = LimitsConfig{MaxClients: 4, MaxPerIP: 2, IPv4Cidr: 32, IPv6Cidr: 64, Exempt: []string{"192.0.2.99"}}
+	server := MakeServerFromConfig(config)
+	server.resolver = fakeResolver{}
+
+	var connect = func(ip string) string {
+		client, serverConn := makeTestConn()
+		// Refused connections are written to before newIrcConnection returns
+		go newIrcConnection(server, proxiedConn{serverConn, &net.TCPAddr{IP: net.ParseIP(ip), Port: 6667}})
+		return readLine(client)
+	}
+
+	// Addresses in the same /64 share a limit
+	assert.Contains(t, connect("2001:db8::1"), "NOTICE")
+	assert.Contains(t, connect("2001:db8::2"), "NOTICE")
+	assert.Equal(t, "ERROR :Closing Link: 2001:db8::3 Too many connections from your IP\r\n", connect("2001:db8::3"))
+	assert.Contains(t, connect("2001:db8:0:1::1"), "NOTICE")
+
+	assert.Contains(t, connect("192.0.2.1"), "NOTICE")
+	assert.Equal(t, "ERROR :Closing Link: 192.0.2.2 Sorry, server is full - try later\r\n", connect("192.0.2.2"))
+	assert.Contains(t, connect("192.0.2.99"), "NOTICE")
+}
+
+func TestConnectionThrottle(t *testing.T) {
+	config := DefaultConfig("bar.example.com")
+	config.Limits.ThrottleCount = 2
+	config.Limits.ThrottleWindow = time.Minute
+	config.Limits.IPv4Cidr = 24
+	context := serverContext{config: config, clients: map[string]clientInfo{}, throttle: map[string][]time.Time{}, connectionsPerIP: map[string]int{}}
+
+	now := time.Now()
+	assert.Equal(t, "", checkConnectionLimits(&context, "192.0.2.1", now))
+	assert.Equal(t, "", checkConnectionLimits(&context, "192.0.2.2", now.Add(10*time.Second)))
+	assert.Equal(t, "Your host is trying to (re)connect too fast -- throttled", checkConnectionLimits(&context, "192.0.2.3", now.Add(20*time.Second)))
+	assert.Equal(t, "", checkConnectionLimits(&context, "198.51.100.1", now.Add(20*time.Second)))
+	// Mapped IPv4 addresses count as IPv4
+	assert.NotEqual(t, "", checkConnectionLimits(&context, "::ffff:192.0.2.4", now.Add(30*time.Second)))
+	// Connections without an IP are only counted towards max_clients
+	assert.Equal(t, "", checkConnectionLimits(&context, "", now.Add(30*time.Second)))
+
+	// Refused attempts count too, so the range stays throttled until it slows down
+	assert.NotEqual(t, "", checkConnectionLimits(&context, "192.0.2.1", now.Add(65*time.Second)))
+	assert.Equal(t, "", checkConnectionLimits(&context, "192.0.2.1", now.Add(95*time.Second)))
+	sweepThrottle(&context, now.Add(95*time.Second))
+	assert.NotContains(t, context.throttle, "198.51.100.0/24")
+	assert.Contains(t, context.throttle, "192.0.2.0/24")
+
+	// Connections count towards max_per_ip until they close
+	context.config.Limits.ThrottleCount = 0
+	context.config.Limits.MaxPerIP = 1
+	countConnection(&context, "203.0.113.1", 1)
+	assert.Equal(t, "Too many connections from your IP", checkConnectionLimits(&context, "203.0.113.2", now))
+	countConnection(&context, "203.0.113.1", -1)
+	assert.Equal(t, "", checkConnectionLimits(&context, "203.0.113.2", now))
+	assert.Empty(t, context.connectionsPerIP)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// How often throttle entries for ranges which stopped connecting are forgotten, see sweepThrottle
+const throttleSweepInterval = time.Minute
+
+// Returns why a new connection from ip has to be refused, or "" if it can be accepted.
+// ip is empty for connections which aren't over IP, such as Unix sockets, which only count towards max_clients.
+// Every attempt counts towards the throttle, so clients which keep retrying stay throttled.
+// This runs for every connection, so it only looks at the connection's own range.
+func checkConnectionLimits(context *serverContext, ip string, now time.Time) string {
+	limits := context.config.Limits
+	addr, err := netip.ParseAddr(ip)
+	if err == nil && slices.ContainsFunc(limits.Exempt, func(mask string) bool { return matchIP(mask, addr) }) {
+		return ""
+	}
+
+	if limits.MaxClients > 0 && len(context.clients) >= limits.MaxClients {
+		return "Sorry, server is full - try later"
+	}
+	if err != nil {
+		return ""
+	}
+
+	key := limitKey(limits, addr)
+	if limits.ThrottleCount > 0 {
+		times := append(recentConnections(context.throttle[key], limits.ThrottleWindow, now), now)
+		context.throttle[key] = times
+		if len(times) > limits.ThrottleCount {
+			return "Your host is trying to (re)connect too fast -- throttled"
+		}
+	}
+
+	if limits.MaxPerIP > 0 && context.connectionsPerIP[key] >= limits.MaxPerIP {
+		return "Too many connections from your IP"
+	}
+
+	return ""
+}
+
+// Forgets ranges with no connections inside the throttle window, so the map doesn't grow forever
+func sweepThrottle(context *serverContext, now time.Time) {
+	for key, times := range context.throttle {
+		times = recentConnections(times, context.config.Limits.ThrottleWindow, now)
+		if len(times) == 0 {
+			delete(context.throttle, key)
+		} else {
+			context.throttle[key] = times
+		}
+	}
+}
+
+func recentConnections(times []time.Time, window time.Duration, now time.Time) []time.Time {
+	return slices.DeleteFunc(times, func(t time.Time) bool { return now.Sub(t) >= window })
+}
+
+// Counts a connection from ip towards max_per_ip when it opens (1) or closes (-1)
+func countConnection(context *serverContext, ip string, delta int) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return
+	}
+
+	key := limitKey(context.config.Limits, addr)
+	context.connectionsPerIP[key] += delta
+	if context.connectionsPerIP[key] <= 0 {
+		delete(context.connectionsPerIP, key)
+	}
+}
+
+// Counts every open connection again, as a new ipv4_cidr or ipv6_cidr groups them differently
+func recountConnections(context *serverContext) {
+	clear(context.connectionsPerIP)
+	for _, client := range context.clients {
+		countConnection(context, client.ip, 1)
+	}
+}
+
+// Addresses in the same range share limits, so IPv6 clients can't get around them by using several addresses
+func limitKey(limits LimitsConfig, addr netip.Addr) string {
+	addr = addr.Unmap()
+	bits := limits.IPv6Cidr
+	if addr.Is4() {
+		bits = limits.IPv4Cidr
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return addr.String()
+	}
+	return prefix.String()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Accepts client connections with the settings from its ListenerConfig
+type listener struct {
+	net.Listener
+	config ListenerConfig
+	// nil unless the listener accepts TLS connections
+	tlsConfig *tls.Config
+}
+
+func openListener(config ListenerConfig, certificates *certificateStore) (listener, error) {
+	l := listener{config: config}
+
+	if config.network() == "unix" {
+		// Left behind if the server didn't stop cleanly, unless another server is still using it
+		info, err := os.Stat(config.Address)
+		if err == nil && info.Mode()&os.ModeSocket != 0 {
+			conn, err := net.DialTimeout("unix", config.Address, time.Second)
+			if err == nil {
+				conn.Close()
+				return l, fmt.Errorf("%v: another server is already listening", config.Address)
+			}
+			os.Remove(config.Address)
+		}
+	}
+
+	var err error
+	if config.isTLS() {
+		l.tlsConfig, err = certificates.tlsConfig(certificateFiles{config.Certificate, config.Key})
+		if err != nil {
+			return l, err
+		}
+	}
+
+	l.Listener, err = net.Listen(config.network(), config.Address)
+	return l, err
+}
+
+// How long to wait before accepting again after an error
+const acceptRetryDelay = 100 * time.Millisecond
+
+func acceptConnections(server ServerInfo, l listener) {
+	for {
+		// blocks until a new connection comes in
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// Usually temporary, such as running out of file descriptors
+			fmt.Println(err)
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+
+		// Reading the PROXY header may block, so it mustn't hold up the next client
+		go l.serve(server, conn)
+	}
+}
+
+// Reads the PROXY header and sets up TLS if the listener needs them,
+// then hands the connection over to newClassConnection
+func (l listener) serve(server ServerInfo, conn net.Conn) {
+	if l.config.Proxy {
+		// Anyone else could claim to be any address
+		if !l.isTrustedProxy(conn) {
+			fmt.Printf("PROXY header from untrusted address %v\n", conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+		var err error
+		conn, err = readProxyHeader(conn)
+		if err != nil {
+			fmt.Println(err)
+			conn.Close()
+			return
+		}
+	}
+	if l.tlsConfig != nil {
+		conn = tls.Server(conn, l.tlsConfig)
+	}
+
+	if rejectIfBanned(server, conn) {
+		return
+	}
+
+	newClassConnection(server, conn, l.config.class())
+}
+
+// Whether the connection comes from one of the listener's proxy_from hosts
+func (l listener) isTrustedProxy(conn net.Conn) bool {
+	addr, err := netip.ParseAddr(remoteIP(conn))
+	if err != nil {
+		// Unix sockets have no address, and only local users can connect
+		return l.config.network() == "unix"
+	}
+
+	return slices.ContainsFunc(l.config.ProxyFrom, func(mask string) bool { return matchIP(mask, addr) })
+}
+
+// A connection accepted through a proxy, which reports the address of the client rather than the proxy
+type proxiedConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c proxiedConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// How long a proxy has to send the PROXY header
+const proxyHeaderTimeout = 5 * time.Second
+
+// The longest version 1 header, including the trailing "\r\n"
+const maxProxyHeaderLength = 107
+
+// Reads a PROXY protocol version 1 header, such as "PROXY TCP4 192.0.2.1 198.51.100.1 56324 6667\r\n".
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	// Read a byte at a time so nothing after the header is consumed
+	header := []byte{}
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(header, []byte("\r\n")) {
+		if len(header) == maxProxyHeaderLength {
+			return conn, errors.New("PROXY header is too long")
+		}
+		_, err := conn.Read(b)
+		if err != nil {
+			return conn, fmt.Errorf("could not read PROXY header: %w", err)
+		}
+		header = append(header, b[0])
+	}
+
+	addr, err := parseProxyHeader(strings.TrimSuffix(string(header), "\r\n"))
+	if err != nil {
+		return conn, err
+	}
+	if addr == nil {
+		return conn, nil
+	}
+	return proxiedConn{conn, addr}, nil
+}
+
+// Returns the address of the client, or nil if the proxy doesn't know it
+func parseProxyHeader(header string) (net.Addr, error) {
+	fields := strings.Split(header, " ")
+	if fields[0] != "PROXY" {
+		return nil, fmt.Errorf("invalid PROXY header %q", header)
+	}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY header %q", header)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid PROXY header %q", header)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
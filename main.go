@@ -1,43 +1,119 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"net"
 	"os"
+	"os/signal"
+	"syscall"
 	// "strconv"
 	// "strings"
-	// "time"
 )
 
-var count = 0
+// Reported by VERSION and INFO.
+// Set when building with -ldflags "-X main.version=<version>".
+var version = "0.0"
 
 func main() {
-	arguments := os.Args
-	if len(arguments) == 1 {
-		fmt.Println("Please provide port number")
+	// Generates password hashes for operator blocks
+	if len(os.Args) == 3 && os.Args[1] == "mkpasswd" {
+		fmt.Println(hashPassword(os.Args[2]))
 		return
 	}
 
-	PORT := ":" + arguments[1]
-	l, err := net.Listen("tcp", PORT)
-	if err != nil {
-		fmt.Println(err)
-		return
+	configPath := flag.String("config", "", "path to the YAML config file, see ircd.example.yaml")
+	flag.Parse()
+
+	var config Config
+	if len(*configPath) > 0 {
+		var err error
+		config, err = LoadConfig(*configPath)
+		if err != nil {
+			fmt.Println("Invalid config:", err)
+			os.Exit(1)
+		}
+	} else if flag.NArg() == 1 {
+		// Without a config file, listen on the given port with the defaults
+		config = DefaultConfig(defaultServerName())
+		config.Listeners = []ListenerConfig{{Address: ":" + flag.Arg(0)}}
+		config.BanFile = "bans.json"
+	} else {
+		fmt.Println("Please provide a config file with -config, or a port number")
+		os.Exit(1)
 	}
-	defer l.Close()
 
-	server := MakeServer(l.Addr().String())
+	server := MakeServerFromConfig(config)
 
-	for {
-		// blocks until a new connection comes in
-		conn, err := l.Accept()
+	listeners := []listener{}
+	for _, listenerConfig := range config.Listeners {
+		l, err := openListener(listenerConfig, server.certificates)
 		if err != nil {
 			fmt.Println(err)
-			return
+			os.Exit(1)
+		}
+		defer l.Close()
+		listeners = append(listeners, l)
+	}
+
+	// Reload the config on SIGHUP, as with REHASH
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			changes, err := rehash(server)
+			if err != nil {
+				fmt.Println("Rehash failed:", err)
+				continue
+			}
+			for _, change := range changes {
+				fmt.Println("Rehash:", change)
+			}
 		}
+	}()
+
+	// Disconnect everyone cleanly on SIGINT or SIGTERM, as with DIE
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-interrupt
+		shutdownServer(server, fmt.Sprintf("Received %v", s), false)
+	}()
+
+	for _, l := range listeners {
+		go acceptConnections(server, l)
+	}
 
-		// launch coroutine for handling the new connection
-		newIrcConnection(server, conn)
-		count++
+	// Stop accepting as soon as the shutdown starts, rather than once everyone has gone
+	<-server.stopping
+	for _, l := range listeners {
+		l.Close()
 	}
+	shutdown := <-server.stopped
+	fmt.Println(shutdown.message())
+
+	if shutdown.restart {
+		restart()
+	}
+}
+
+// The machine's hostname, as the server name prefixes messages and so can't be an address such as ":6667"
+func defaultServerName() string {
+	hostname, err := os.Hostname()
+	if err != nil || !isValidHostname(hostname) {
+		return "localhost"
+	}
+
+	return hostname
+}
+
+// Replaces the process with a new copy of the server with the same arguments, so the config is read again.
+// The PID stays the same, so supervisors such as systemd keep track of it.
+func restart() {
+	path, err := os.Executable()
+	if err == nil {
+		err = syscall.Exec(path, os.Args, os.Environ())
+	}
+
+	fmt.Println("Could not restart:", err)
+	os.Exit(1)
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+)
+
+// Casemappings supported in the CASEMAPPING ISUPPORT token.
+// Maps a nick or channel name to the form used as a key in the server state.
+// rfc7613 is not supported as it requires Unicode normalisation.
+var casemappings = map[string](func(string) string){
+	"ascii":          foldAscii,
+	"rfc1459":        foldRfc1459,
+	"strict-rfc1459": foldStrictRfc1459,
+}
+
+func foldAscii(name string) string {
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' {
+			return r + ('a' - 'A')
+		}
+		return r
+	}, name)
+}
+
+// "[]\^" are the upper case equivalents of "{}|~"
+func foldRfc1459(name string) string {
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= '^' {
+			return r + ('a' - 'A')
+		}
+		return r
+	}, name)
+}
+
+// As rfc1459, but "^" and "~" are distinct
+func foldStrictRfc1459(name string) string {
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= ']' {
+			return r + ('a' - 'A')
+		}
+		return r
+	}, name)
+}
+
+// Checks against the RFC2812 grammar:
+//
+//	nickname = ( letter / special ) *( letter / digit / special / "-" )
+//	special  = "[", "]", "\", "`", "_", "^", "{", "|", "}"
+func isValidNick(nick string, maxLength int) bool {
+	if len(nick) == 0 || len(nick) > maxLength {
+		return false
+	}
+
+	for i, c := range nick {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case strings.ContainsRune("[]\\`_^{|}", c):
+		case i > 0 && ('0' <= c && c <= '9' || c == '-'):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func isChannelName(name string) bool {
+	return len(name) > 0 && strings.ContainsRune("&#+!", rune(name[0]))
+}
+
+// Matches name against a mask where "*" matches any number of characters
+// and "?" matches exactly one. Both are casefolded before comparing.
+func matchMask(mask string, name string, casefold func(string) string) bool {
+	mask = casefold(mask)
+	name = casefold(name)
+
+	// Position to backtrack to on a mismatch after the last "*"
+	star, next := -1, 0
+	m, n := 0, 0
+	for n < len(name) {
+		switch {
+		case m < len(mask) && (mask[m] == '?' || mask[m] == name[n]):
+			m++
+			n++
+		case m < len(mask) && mask[m] == '*':
+			star, next = m, n
+			m++
+		case star >= 0:
+			next++
+			m, n = star+1, next
+		default:
+			return false
+		}
+	}
+
+	for m < len(mask) && mask[m] == '*' {
+		m++
+	}
+	return m == len(mask)
+}
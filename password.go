@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Passwords are stored as "pbkdf2-sha256$<iterations>$<salt>$<key>",
+// with the salt and key base64 encoded.
+const passwordScheme = "pbkdf2-sha256"
+const passwordIterations = 100000
+
+func hashPassword(password string) string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+
+	key := pbkdf2Sha256([]byte(password), salt, passwordIterations)
+	return fmt.Sprintf("%v$%v$%v$%v", passwordScheme, passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// Returns false if the hash is malformed
+func checkPassword(hash string, password string) bool {
+	iterations, salt, expected, valid := parsePasswordHash(hash)
+	if !valid {
+		return false
+	}
+
+	key := pbkdf2Sha256([]byte(password), salt, iterations)
+	return hmac.Equal(key, expected)
+}
+
+func isPasswordHash(hash string) bool {
+	_, _, _, valid := parsePasswordHash(hash)
+	return valid
+}
+
+func parsePasswordHash(hash string) (iterations int, salt []byte, key []byte, valid bool) {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 4 || fields[0] != passwordScheme {
+		return
+	}
+
+	iterations, err := strconv.Atoi(fields[1])
+	if err != nil || iterations < 1 {
+		return
+	}
+	salt, err = base64.RawStdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return
+	}
+	key, err = base64.RawStdEncoding.DecodeString(fields[3])
+	if err != nil {
+		return
+	}
+
+	return iterations, salt, key, true
+}
+
+// RFC 8018 PBKDF2, only deriving a single block
+func pbkdf2Sha256(password []byte, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+
+	prf.Write(salt)
+	prf.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := prf.Sum(nil)
+
+	key := make([]byte, len(u))
+	copy(key, u)
+	for range iterations - 1 {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for i := range key {
+			key[i] ^= u[i]
+		}
+	}
+
+	return key
+}
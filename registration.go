@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// How far a connection has got through registration:
+//
+//	phaseConnected: nothing has been sent yet, so WEBIRC is still allowed
+//	phaseRegistering: PASS, CAP, NICK, USER and AUTHENTICATE are being sent, in any order
+//	phaseRegistered: see continueRegistration
+//	phaseClosed: closeConnection was called, nothing more is read
+type registrationPhase int
+
+const (
+	phaseConnected registrationPhase = iota
+	phaseRegistering
+	phaseRegistered
+	phaseClosed
+)
+
+// A SASL exchange in progress, see handleAuthenticate
+type saslState struct {
+	// Empty if there is no exchange in progress
+	mechanism string
+	// The base64 encoded message received so far
+	data string
+}
+
+var saslMechanisms = []string{"PLAIN", "EXTERNAL"}
+
+// AUTHENTICATE messages are split into chunks of this length, a shorter one ends the message
+const saslChunkLength = 400
+
+// Longer messages are rejected, valid PLAIN and EXTERNAL messages are much shorter
+const maxSaslLength = 4 * saslChunkLength
+
+// Registers the connection once it has a nick and user, CAP negotiation has ended and no SASL exchange is in progress.
+// Otherwise waits silently for the rest.
+func continueRegistration(server ServerInfo, state *connectionState) {
+	if isRegistered(*state) || len(state.nick) == 0 || len(state.user) == 0 || state.negotiatingCaps || len(state.sasl.mechanism) > 0 {
+		return
+	}
+
+	if len(state.class.Password) > 0 && !checkPassword(state.class.Password, state.password) {
+		state.sendq.send(fmt.Sprintf(":%v 464 %v :Password incorrect\r\n", server.name, state.nick))
+		closeConnection(server, state, "Bad password")
+		return
+	}
+
+	for _, r := range tryRegister(server, state, state.nick) {
+		state.sendq.send(r)
+	}
+}
+
+func handlePass(server ServerInfo, state *connectionState, params []string) {
+	if isRegistered(*state) {
+		state.sendq.send(fmt.Sprintf(":%v 462 %v :Unauthorized command (already registered)\r\n", server.name, state.nick))
+		return
+	}
+	if len(params) < 1 {
+		state.sendq.send(errNeedMoreParams(server.name, "*", "PASS"))
+		return
+	}
+
+	state.password = params[0]
+}
+
+// WEBIRC <password> <gateway> <hostname> <ip> [:<options>]
+// Sent by trusted gateways such as web clients to pass on the address of their user,
+// see https://ircv3.net/specs/extensions/webirc
+func handleWebirc(server ServerInfo, state *connectionState, params []string) {
+	if state.phase != phaseConnected || len(params) < 4 {
+		closeConnection(server, state, "Invalid WEBIRC command")
+		return
+	}
+
+	result, passwords := sendCommandToServer(server.commandChan, GET_WEBIRC_PASSWORDS, "", []string{state.ip})
+	addr, err := netip.ParseAddr(params[3])
+	if result != OK || err != nil || !slices.ContainsFunc(strings.Split(passwords, "\n"), func(hash string) bool {
+		return checkPassword(hash, params[0])
+	}) {
+		closeConnection(server, state, "Invalid WEBIRC command")
+		return
+	}
+
+	// The gateway's own address was checked when it connected, but not its user's
+	ip := addr.Unmap().String()
+	result, reason := sendCommandToServer(server.commandChan, CHECK_DLINE, "", []string{ip})
+	if result == ERR_YOUREBANNEDCREEP {
+		closeConnection(server, state, fmt.Sprintf("D-lined (%v)", reason))
+		return
+	}
+
+	state.ip = ip
+	state.host = formatHost(&net.TCPAddr{IP: net.ParseIP(ip)})
+	if isValidHostname(params[2]) {
+		state.host = params[2]
+	}
+	if len(params) > 4 && slices.Contains(strings.Fields(params[4]), "secure") {
+		state.secure = true
+	}
+}
+
+// Logs in to an AccountConfig with SASL PLAIN or EXTERNAL, see https://ircv3.net/specs/extensions/sasl-3.1
+func handleAuthenticate(server ServerInfo, state *connectionState, params []string) {
+	nick := state.nick
+	if len(nick) == 0 {
+		nick = "*"
+	}
+	var fail = func(numeric string, message string) {
+		state.sasl = saslState{}
+		state.sendq.send(fmt.Sprintf(":%v %v %v :%v\r\n", server.name, numeric, nick, message))
+		continueRegistration(server, state)
+	}
+
+	if len(state.account) > 0 {
+		state.sendq.send(fmt.Sprintf(":%v 907 %v :You have already authenticated using SASL\r\n", server.name, nick))
+		return
+	}
+	if isRegistered(*state) {
+		state.sendq.send(fmt.Sprintf(":%v 462 %v :Unauthorized command (already registered)\r\n", server.name, nick))
+		return
+	}
+	if len(params) < 1 {
+		state.sendq.send(errNeedMoreParams(server.name, nick, "AUTHENTICATE"))
+		return
+	}
+	if !state.capabilities["sasl"] {
+		fail("904", "SASL authentication failed")
+		return
+	}
+
+	// The first message picks the mechanism
+	if len(state.sasl.mechanism) == 0 {
+		mechanism := strings.ToUpper(params[0])
+		if !slices.Contains(saslMechanisms, mechanism) {
+			state.sendq.send(fmt.Sprintf(":%v 908 %v %v :are available SASL mechanisms\r\n", server.name, nick, strings.Join(saslMechanisms, ",")))
+			fail("904", "SASL authentication failed")
+			return
+		}
+		state.sasl.mechanism = mechanism
+		state.sendq.send("AUTHENTICATE +\r\n")
+		return
+	}
+
+	if params[0] == "*" {
+		fail("906", "SASL authentication aborted")
+		return
+	}
+	if len(params[0]) > saslChunkLength || len(state.sasl.data)+len(params[0]) > maxSaslLength {
+		fail("905", "SASL message too long")
+		return
+	}
+	if params[0] != "+" {
+		state.sasl.data += params[0]
+	}
+	if len(params[0]) == saslChunkLength {
+		return
+	}
+
+	account, valid := checkSasl(server, state)
+	if !valid {
+		fail("904", "SASL authentication failed")
+		return
+	}
+
+	user := state.user
+	if len(user) == 0 {
+		user = "*"
+	}
+	state.sasl = saslState{}
+	state.account = account
+	state.sendq.send(fmt.Sprintf(":%v 900 %v %v!%v@%v %v :You are now logged in as %v\r\n", server.name, nick, nick, user, state.host, account, account))
+	state.sendq.send(fmt.Sprintf(":%v 903 %v :SASL authentication successful\r\n", server.name, nick))
+	continueRegistration(server, state)
+}
+
+// Returns the account the finished SASL message logs in to
+func checkSasl(server ServerInfo, state *connectionState) (string, bool) {
+	message, err := base64.StdEncoding.DecodeString(state.sasl.data)
+	if err != nil {
+		return "", false
+	}
+
+	switch state.sasl.mechanism {
+	case "PLAIN":
+		// authzid NUL authcid NUL passwd, the authzid may be left out
+		fields := strings.Split(string(message), "\x00")
+		if len(fields) != 3 || len(fields[1]) == 0 || (len(fields[0]) > 0 && fields[0] != fields[1]) {
+			return "", false
+		}
+		// Checked here rather than by the server, since hashing the password is slow
+		result, hash := sendCommandToServer(server.commandChan, GET_ACCOUNT_PASSWORD, state.nick, fields[1:2])
+		return fields[1], result == OK && checkPassword(hash, fields[2])
+	case "EXTERNAL":
+		if len(state.certfp) == 0 {
+			return "", false
+		}
+		result, account := sendCommandToServer(server.commandChan, CHECK_ACCOUNT, state.nick, []string{string(message), state.certfp})
+		return account, result == OK
+	}
+
+	return "", false
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+)
+
+// Messages waiting to be written to a connection.
+// Sending never blocks, so a client which reads slowly can't hold up the server or other clients.
+// Once more than limit bytes are waiting the queue is dropped and full is closed,
+// after which the connection is closed with "Max SendQ exceeded".
+type sendQueue struct {
+	mutex    sync.Mutex
+	messages []string
+	// Bytes waiting in messages
+	size     int
+	limit    int
+	exceeded bool
+	// Has a value while there are messages waiting, see take
+	ready chan bool
+	full  chan bool
+}
+
+func newSendQueue(limit int) *sendQueue {
+	return &sendQueue{
+		limit: limit,
+		ready: make(chan bool, 1),
+		full:  make(chan bool),
+	}
+}
+
+// Queues message for the writer, dropping it if the queue is full
+func (q *sendQueue) send(message string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.exceeded {
+		return
+	}
+
+	if q.size+len(message) > q.limit {
+		q.exceeded = true
+		q.messages = nil
+		q.size = 0
+		close(q.full)
+		return
+	}
+
+	q.messages = append(q.messages, message)
+	q.size += len(message)
+	select {
+	case q.ready <- true:
+	default:
+	}
+}
+
+// Removes and returns every waiting message
+func (q *sendQueue) take() []string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	messages := q.messages
+	q.messages = nil
+	q.size = 0
+	return messages
+}
+
+// The number of bytes waiting, as shown by STATS l
+func (q *sendQueue) length() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.size
+}
@@ -1,17 +1,42 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"net/netip"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type serverContext struct {
-	info ServerInfo
-	// The key is the nickname
-	users       map[string]userInfo
-	channels    map[string]channelInfo
-	connections int
+	info   ServerInfo
+	config Config
+	// The key is the casefolded nickname
+	users map[string]userInfo
+	// The key is the casefolded channel name
+	channels map[string]channelInfo
+	// Every open connection, registered or not. The key is the connection id.
+	clients map[string]clientInfo
+	// Used to give each connection a unique id
+	connectionCount int
+	// Recent connection times for each range of IPs, see checkConnectionLimits
+	throttle map[string][]time.Time
+	// Open connections for each range of IPs, see countConnection
+	connectionsPerIP map[string]int
+	bans             banList
+	// Set once a shutdown starts, the server stops when every connection has closed
+	shutdown *Shutdown
+	started  time.Time
+	// Lines of the message of the day, empty if there isn't one
+	motd []string
+	// The most users registered at once, for LUSERS
+	maxUsers int
+	// Converts nicks and channel names to their map keys
+	casefold func(string) string
 }
 
 // TODO: rename as ServerHandle?
@@ -20,18 +45,92 @@ type ServerInfo struct {
 	// Used to receive commands from the user connection
 	commandChan      chan<- Command
 	registrationChan chan<- Registration
+	connectionChan   chan<- NewConnection
+	rehashChan       chan<- Rehash
+	shutdownChan     chan<- Shutdown
+	// Closed as soon as a shutdown starts, so listeners can stop accepting
+	stopping <-chan struct{}
+	// Receives the shutdown once every connection has closed and the server has stopped
+	stopped <-chan Shutdown
+	// Shared with every connection, see STATS m
+	usage *commandUsage
+	// The file the config was loaded from, empty if there isn't one
+	configPath string
+	// Used by TLS listeners, reloaded by REHASH
+	certificates *certificateStore
+	// Finds the hostnames of new connections
+	resolver hostResolver
+	// Converts nicks for comparing, the casemapping can't change without a restart
+	casefold func(string) string
 }
 
 type userInfo struct {
-	user     string
-	host     string
+	// Identifies the connection, as nicks can be reused after it closes
+	id string
+	// The nick as the user chose it, rather than casefolded
+	nick string
+	user string
+	// Shown to other users, cloaked when the user has +x
+	host string
+	// The host before cloaking, used for K-lines and OPER and shown to operators
+	realHost string
+	// Used to match D-lines, empty if the connection is not over IP
+	ip string
+	// SHA-256 fingerprint of the TLS client certificate, empty if there isn't one
+	certfp   string
 	realName string
+	away     string
+	// Set user modes, one of the characters in supportedUserModes.
+	// 'o' is set by OPER, 'Z' when connected over TLS, 'x' when the host is cloaked.
+	modes map[byte]bool
+	// Categories of server notice the user gets with +s, see supportedSnomasks
+	snomasks map[byte]bool
+	// Granted by the operators class
+	privileges []string
+	// The block used with OPER, checked again on rehash by refreshOpers
+	oper OperConfig
+	// The AccountConfig logged in to with SASL, empty if there isn't one
+	account string
+	// Enabled with CAP REQ
+	capabilities map[string]bool
+	// Nicks this user has asked to be notified about.
+	// Maps the casefolded nick to the nick as given.
+	monitoring map[string]string
 	// Used to send messages to the user connection
-	// Must be non blocking
-	channel chan<- string
+	sendq *sendQueue
+	// Closes the connection, see requestQuit
+	quit chan<- bool
+}
+
+const supportedUserModes = "ioswxZ"
+
+// Server notice categories operators can subscribe to with +s:
+//
+//	c: clients connecting and exiting
+//	f: flood control
+//	k: kills and bans
+//	n: nick changes
+//	o: failed OPER attempts
+const supportedSnomasks = "cfkno"
+
+type clientInfo struct {
+	host string
+	// Empty if the connection is not over IP
+	ip string
+	// The ClassConfig of the listener which accepted the connection
+	class string
+	// Used to send messages to the connection
+	sendq *sendQueue
+	// Closes the connection, see requestQuit
+	quit   chan<- bool
+	stats  *connectionStats
+	opened time.Time
 }
 
 type channelInfo struct {
+	// The name as given by the creator, rather than casefolded
+	name string
+	// The key is the casefolded nick
 	members map[string]channelMember
 }
 
@@ -52,56 +151,218 @@ type Response struct {
 	params string
 }
 
+// Sent when a client connects, see OpenedConnection
+type NewConnection struct {
+	host  string
+	ip    string
+	class string
+	quit  chan<- bool
+	stats *connectionStats
+	// Must be non blocking.
+	responseChan chan OpenedConnection
+}
+
+// The response to a NewConnection
+type OpenedConnection struct {
+	id string
+	// The settings of the connection's class when it was opened
+	class ClassConfig
+	sendq *sendQueue
+	// Why the connection was refused, empty if it wasn't. See checkConnectionLimits.
+	refused string
+}
+
+// Disconnects everyone and stops the server, see shutdownServer
+type Shutdown struct {
+	reason string
+	// Set by RESTART, the process should start again once the server stops
+	restart bool
+}
+
+// How long to wait for connections to close before stopping anyway
+const shutdownTimeout = 5 * time.Second
+
+// Replaces the running config, see rehash
+type Rehash struct {
+	config Config
+	// Must be non blocking.
+	responseChan chan rehashResult
+}
+
+type rehashResult struct {
+	// Describes each setting which changed
+	changes []string
+	err     error
+}
+
 type Registration struct {
-	nick        string
-	user        string
-	host        string
-	realName    string
-	messageChan chan<- string
+	id           string
+	nick         string
+	user         string
+	host         string
+	ip           string
+	secure       bool
+	certfp       string
+	account      string
+	realName     string
+	capabilities []string
+	sendq        *sendQueue
+	quit         chan<- bool
 }
 
 // Error values
 const (
-	OK                 = 0
-	ERR_NOSUCHNICKNAME = 401
-	ERR_NOSUCHCHANNEL  = 403
-	ERR_NICKNAMEINUSE  = 433
-	ERR_NOTONCHANNEL   = 441
+	OK                   = 0
+	ERR_NOSUCHNICKNAME   = 401
+	ERR_NOSUCHCHANNEL    = 403
+	ERR_NOMOTD           = 422
+	ERR_NOADMININFO      = 423
+	ERR_ERRONEUSNICKNAME = 432
+	ERR_NICKNAMEINUSE    = 433
+	ERR_NOTONCHANNEL     = 441
+	ERR_PASSWDMISMATCH   = 464
+	ERR_YOUREBANNEDCREEP = 465
+	ERR_NOPRIVILEGES     = 481
+	ERR_NOOPERHOST       = 491
+	ERR_UMODEUNKNOWNFLAG = 501
+	ERR_SASLFAIL         = 904
+	// Not a numeric reply, used when removing a ban which doesn't exist
+	ERR_NOSUCHBAN = -1
+	// Not a numeric reply, used when a user is not connected over TLS
+	ERR_NOTSECURE = -2
 )
 
 func MakeServer(serverName string) (server ServerInfo) {
+	return MakeServerFromConfig(DefaultConfig(serverName))
+}
+
+func MakeServerFromConfig(config Config) (server ServerInfo) {
 	commandChan := make(chan Command)
 	registrationChan := make(chan Registration)
+	connectionChan := make(chan NewConnection)
+	rehashChan := make(chan Rehash)
+	shutdownChan := make(chan Shutdown)
+	stopping := make(chan struct{})
+	stopped := make(chan Shutdown, 1)
+
+	casefold, valid := casemappings[config.Casemapping]
+	if !valid {
+		panic(fmt.Sprintf("Unsupported casemapping %v", config.Casemapping))
+	}
 
 	server = ServerInfo{
-		serverName,
+		config.Name,
 		commandChan,
 		registrationChan,
+		connectionChan,
+		rehashChan,
+		shutdownChan,
+		stopping,
+		stopped,
+		newCommandUsage(),
+		config.Path,
+		newCertificateStore(),
+		net.DefaultResolver,
+		casefold,
+	}
+
+	bans, err := loadBans(config.BanFile)
+	if err != nil {
+		fmt.Printf("Could not load bans from %v: %v\n", config.BanFile, err)
+	}
+	motd, err := loadMotd(config.MotdFile)
+	if err != nil {
+		fmt.Printf("Could not load the MOTD from %v: %v\n", config.MotdFile, err)
 	}
 
 	context := serverContext{
 		server,
+		config,
 		make(map[string]userInfo),
 		make(map[string]channelInfo),
+		make(map[string]clientInfo),
+		0,
+		make(map[string][]time.Time),
+		make(map[string]int),
+		bans,
+		nil,
+		time.Now(),
+		motd,
 		0,
+		casefold,
 	}
 
 	go func() {
-		for {
+		var timeout <-chan time.Time
+		sweep := time.NewTicker(throttleSweepInterval)
+		defer sweep.Stop()
+
+		for context.shutdown == nil || len(context.clients) > 0 {
 			select {
+			case c := <-connectionChan:
+				opened := connectionOpened(&context, c)
+				c.responseChan <- opened
+				if context.shutdown != nil && len(opened.refused) == 0 {
+					closeClient(&context, opened.id, context.shutdown.message())
+				}
+			case s := <-shutdownChan:
+				if context.shutdown == nil {
+					context.shutdown = &s
+					close(stopping)
+					timeout = time.After(shutdownTimeout)
+					for id := range context.clients {
+						closeClient(&context, id, s.message())
+					}
+				}
+			case <-timeout:
+				// Give up on connections which are stuck
+				clear(context.clients)
+				clear(context.connectionsPerIP)
+			case now := <-sweep.C:
+				sweepThrottle(&context, now)
 			case c := <-commandChan:
 				c.responseChan <- updateData[c.command](&context, c.nick, c.params)
 			case r := <-registrationChan:
-				user, present := context.users[r.nick]
+				key := context.casefold(r.nick)
+				user, present := context.users[key]
 				if present {
+					user.id = r.id
 					user.user = r.user
 					user.host = r.host
+					user.realHost = r.host
+					user.ip = r.ip
+					user.certfp = r.certfp
+					user.account = r.account
 					user.realName = r.realName
-					user.channel = r.messageChan
-					context.users[r.nick] = user
+					user.capabilities = make(map[string]bool)
+					for _, c := range r.capabilities {
+						user.capabilities[c] = true
+					}
+					user.modes = make(map[byte]bool)
+					if r.secure {
+						user.modes['Z'] = true
+					}
+					if len(context.config.CloakKey) > 0 {
+						user.modes['x'] = true
+						user.host = cloakHost(context.config.CloakKey, r.host)
+					}
+					user.snomasks = make(map[byte]bool)
+					user.sendq = r.sendq
+					user.quit = r.quit
+					context.users[key] = user
+					context.maxUsers = max(context.maxUsers, registeredUsers(&context))
+					sendServerNotice(&context, 'c', fmt.Sprintf("Client connecting: %v (%v@%v)", user.nick, user.user, user.realHost))
+					notifyMonitors(&context, r.nick, func(watcher string) string {
+						return rplMonOnline(context.info.name, watcher, []string{userPrefix(user)})
+					})
 				}
+			case r := <-rehashChan:
+				changes, err := applyConfig(&context, r.config)
+				r.responseChan <- rehashResult{changes, err}
 			}
 		}
+
+		stopped <- *context.shutdown
 	}()
 
 	return
@@ -109,110 +370,284 @@ func MakeServer(serverName string) (server ServerInfo) {
 
 // Commands
 const (
-	CONNECTION_OPENED = iota
-	CONNECTION_CLOSED
+	CONNECTION_CLOSED = iota
 	NICK
 	QUIT
 	PRIVMSG
-	N_USERS
-	// N_INVISIBLE
-	// N_SERVERS
-	// N_OPERATORS
-	N_CONNECTIONS
-	// N_CHANNELS
+	NOTICE
+	LUSERS
 	GET_HOST_NAME
 	GET_REAL_NAME
+	GET_SECURE
+	GET_REAL_HOST
 	JOIN
 	PART
 	NAMES
+	ISON
+	USERHOST
+	ISUPPORT
+	MONITOR
+	SET_CAPABILITIES
+	SET_REAL_NAME
+	CHANGE_HOST
+	GET_OPER_PASSWORD
+	OPER
+	HAS_PRIVILEGE
+	GET_USER_MODES
+	SET_USER_MODES
+	KILL
+	WALLOPS
+	GLOBOPS
+	STATS
+	GET_ADMIN
+	GET_MOTD
+	CHECK_KLINE
+	CHECK_DLINE
+	ADD_KLINE
+	ADD_DLINE
+	REMOVE_KLINE
+	REMOVE_DLINE
+	GET_WEBIRC_PASSWORDS
+	GET_ACCOUNT_PASSWORD
+	CHECK_ACCOUNT
+	GET_ACCOUNT
+	EXCESS_FLOOD
 )
 
 var updateData = [](func(*serverContext, string, []string) Response){
-	connectionOpened,
 	connectionClosed,
 	setNick,
 	unregisterUser,
 	privMsg,
-	getNumberOfUsers,
-	// getNumberOfInvisible,
-	// getNumberOfOperators,
-	getNumberOfConnections,
-	// getNumberOfChannels
+	notice,
+	getLusers,
 	getHostName,
 	getRealName,
+	getSecure,
+	getRealHost,
 	userJoin,
 	userPart,
 	getNames,
+	getOnlineNicks,
+	getUserHosts,
+	getIsupport,
+	monitor,
+	setCapabilities,
+	setRealName,
+	changeHost,
+	getOperPassword,
+	operUp,
+	hasPrivilege,
+	getUserModes,
+	setUserModes,
+	killUser,
+	wallops,
+	globops,
+	getStats,
+	getAdmin,
+	getMotd,
+	checkKline,
+	checkDline,
+	addKline,
+	addDline,
+	removeKline,
+	removeDline,
+	getWebircPasswords,
+	getAccountPassword,
+	checkAccount,
+	getAccount,
+	excessFlood,
 }
 
-func connectionOpened(context *serverContext, nick string, params []string) Response {
-	context.connections += 1
-	return Response{}
+// Gives the new connection an id, and a send queue sized for its class, unless it is over the limits
+func connectionOpened(context *serverContext, c NewConnection) OpenedConnection {
+	refused := checkConnectionLimits(context, c.ip, time.Now())
+	if len(refused) > 0 {
+		return OpenedConnection{refused: refused}
+	}
+
+	context.connectionCount += 1
+	id := strconv.Itoa(context.connectionCount)
+	class := findClass(context.config, c.class)
+	sendq := newSendQueue(class.SendQ)
+	context.clients[id] = clientInfo{c.host, c.ip, c.class, sendq, c.quit, c.stats, time.Now()}
+	countConnection(context, c.ip, 1)
+
+	return OpenedConnection{id, class, sendq, ""}
 }
+
+// params[0] is the id of the connection
 func connectionClosed(context *serverContext, nick string, params []string) Response {
-	delete(context.users, nick)
-	context.connections -= 1
+	// The user may already have quit, and their nick been taken by someone else
+	key := context.casefold(nick)
+	user, present := context.users[key]
+	if present && user.id == params[0] {
+		if context.shutdown != nil {
+			// Everyone is leaving, so there is no one to tell
+			delete(context.users, key)
+		} else {
+			quitUser(context, key, "Connection closed")
+		}
+	}
+	client, present := context.clients[params[0]]
+	if present {
+		countConnection(context, client.ip, -1)
+		delete(context.clients, params[0])
+	}
 	return Response{}
 }
 
+// params[0] is the current nick of the client, or "*" if not yet registered.
+// Registered users are renamed, which releases their old nick.
 func setNick(context *serverContext, nick string, params []string) Response {
-	// Check if nickname already registered
-	_, present := context.users[nick]
-	if present {
+	if !isValidNick(nick, context.config.NickLength) {
+		return Response{ERR_ERRONEUSNICKNAME, ""}
+	}
+
+	key := context.casefold(nick)
+	oldKey := ""
+	if len(params) > 0 {
+		oldKey = context.casefold(params[0])
+	}
+
+	// Check if nickname already registered, ignoring changes to the case of the nick
+	_, present := context.users[key]
+	if present && key != oldKey {
 		return Response{ERR_NICKNAMEINUSE, ""}
 	}
 
-	// if not, add nickname
-	context.users[nick] = userInfo{}
+	user, present := context.users[oldKey]
+	if !present || !user.isRegistered() {
+		// if not, add nickname
+		context.users[key] = userInfo{nick: nick}
+		return Response{}
+	}
+
+	renameUser(context, oldKey, key, nick)
 
 	return Response{}
 }
 
+// Moves the user and their channel memberships to the new nick and tells everyone who can see them
+func renameUser(context *serverContext, oldKey string, key string, nick string) {
+	user := context.users[oldKey]
+	oldNick := user.nick
+	message := fmt.Sprintf(":%v NICK %v\r\n", userPrefix(user), nick)
+
+	delete(context.users, oldKey)
+	user.nick = nick
+	context.users[key] = user
+
+	for _, channel := range context.channels {
+		member, present := channel.members[oldKey]
+		if present {
+			delete(channel.members, oldKey)
+			channel.members[key] = member
+		}
+	}
+	for k := range channelPeers(context, key) {
+		context.users[k].sendq.send(message)
+	}
+	sendServerNotice(context, 'n', fmt.Sprintf("Nick change: From %v to %v [%v@%v]", oldNick, nick, user.user, user.realHost))
+
+	if key != oldKey {
+		notifyMonitors(context, oldNick, func(watcher string) string {
+			return rplMonOffline(context.info.name, watcher, []string{oldNick})
+		})
+		notifyMonitors(context, nick, func(watcher string) string {
+			return rplMonOnline(context.info.name, watcher, []string{userPrefix(user)})
+		})
+	}
+}
+
+// params[0] is the quit message
 func unregisterUser(context *serverContext, nick string, params []string) Response {
-	delete(context.users, nick)
+	quitUser(context, context.casefold(nick), params[0])
 	return Response{}
 }
 
+// params[0] is the target, params[1] is the text
 func privMsg(context *serverContext, nick string, params []string) Response {
+	return sendMessage(context, nick, "PRIVMSG", params)
+}
+
+// params[0] is the target, params[1] is the text
+func notice(context *serverContext, nick string, params []string) Response {
+	return sendMessage(context, nick, "NOTICE", params)
+}
+
+// Sends a PRIVMSG or NOTICE to a channel or user, prefixed with the sender's visible host
+func sendMessage(context *serverContext, nick string, command string, params []string) Response {
 	target := params[0]
-	message := params[1]
+	sender := context.users[context.casefold(nick)]
+	message := fmt.Sprintf(":%v %v %v :%v\r\n", userPrefix(sender), command, target, params[1])
 
-	targetType := target[0]
-	switch targetType {
-	case '&', '#', '+', '!':
+	if isChannelName(target) {
 		// send to channels
-		channel, present := context.channels[target]
+		channel, present := context.channels[context.casefold(target)]
 		if !present {
 			return Response{ERR_NOSUCHNICKNAME, ""}
 		}
 
 		for k := range channel.members {
-			context.users[k].channel <- message
+			context.users[k].sendq.send(message)
 		}
-	default:
+	} else {
 		// send to user
 		// Check if nickname already registered
-		user, present := context.users[target]
+		user, present := context.users[context.casefold(target)]
 		if !present {
 			return Response{ERR_NOSUCHNICKNAME, ""}
 		}
 
-		user.channel <- message
+		user.sendq.send(message)
 	}
 
 	return Response{}
 }
 
-func getNumberOfUsers(context *serverContext, nick string, params []string) Response {
-	return Response{len(context.users), ""}
-}
+// Responds with the LUSERS reply lines
+func getLusers(context *serverContext, nick string, params []string) Response {
+	users, invisible, operators := 0, 0, 0
+	for _, user := range context.users {
+		if !user.isRegistered() {
+			continue
+		}
+		users += 1
+		if user.modes['i'] {
+			invisible += 1
+		}
+		if user.modes['o'] {
+			operators += 1
+		}
+	}
 
-func getNumberOfConnections(context *serverContext, nick string, params []string) Response {
-	return Response{context.connections, ""}
+	channels := 0
+	for _, channel := range context.channels {
+		if len(channel.members) > 0 {
+			channels += 1
+		}
+	}
+
+	// There is no linking, so this is the only server and every user is local
+	const servers = 1
+	unknown := len(context.clients) - users
+	name := context.info.name
+	replies := []string{
+		fmt.Sprintf(":%v 251 %v :There are %v users and %v invisible on %v servers\r\n", name, nick, users-invisible, invisible, servers),
+		fmt.Sprintf(":%v 252 %v %v :operator(s) online\r\n", name, nick, operators),
+		fmt.Sprintf(":%v 253 %v %v :unknown connection(s)\r\n", name, nick, unknown),
+		fmt.Sprintf(":%v 254 %v %v :channels formed\r\n", name, nick, channels),
+		fmt.Sprintf(":%v 255 %v :I have %v clients and %v servers\r\n", name, nick, users, servers-1),
+		fmt.Sprintf(":%v 265 %v %v %v :Current local users %v, max %v\r\n", name, nick, users, context.maxUsers, users, context.maxUsers),
+		fmt.Sprintf(":%v 266 %v %v %v :Current global users %v, max %v\r\n", name, nick, users, context.maxUsers, users, context.maxUsers),
+	}
+
+	return Response{OK, strings.Join(replies, "")}
 }
 
 func getHostName(context *serverContext, nick string, params []string) Response {
-	user, present := context.users[params[0]]
+	user, present := context.users[context.casefold(params[0])]
 	if !present {
 		return Response{ERR_NOSUCHNICKNAME, ""}
 	}
@@ -220,7 +655,7 @@ func getHostName(context *serverContext, nick string, params []string) Response
 }
 
 func getRealName(context *serverContext, nick string, params []string) Response {
-	user, present := context.users[params[0]]
+	user, present := context.users[context.casefold(params[0])]
 	if !present {
 		return Response{ERR_NOSUCHNICKNAME, ""}
 	}
@@ -228,106 +663,1174 @@ func getRealName(context *serverContext, nick string, params []string) Response
 	return Response{OK, user.realName}
 }
 
+// params[0] is the nick to look up.
+// Responds with their certificate fingerprint if the requester is that user or an operator.
+func getSecure(context *serverContext, nick string, params []string) Response {
+	user, present := context.users[context.casefold(params[0])]
+	if !present {
+		return Response{ERR_NOSUCHNICKNAME, ""}
+	}
+	if !user.modes['Z'] {
+		return Response{ERR_NOTSECURE, ""}
+	}
+
+	requester := context.users[context.casefold(nick)]
+	if requester.id != user.id && !requester.modes['o'] {
+		return Response{OK, ""}
+	}
+	return Response{OK, user.certfp}
+}
+
+// params[0] is the nick to look up.
+// Responds with their host before cloaking and their IP, if the requester is that user or an operator.
+func getRealHost(context *serverContext, nick string, params []string) Response {
+	user, present := context.users[context.casefold(params[0])]
+	if !present {
+		return Response{ERR_NOSUCHNICKNAME, ""}
+	}
+
+	requester := context.users[context.casefold(nick)]
+	if requester.id != user.id && !requester.modes['o'] {
+		return Response{ERR_NOPRIVILEGES, ""}
+	}
+	return Response{OK, strings.TrimSpace(user.realHost + " " + user.ip)}
+}
+
 func userJoin(context *serverContext, nick string, params []string) Response {
-	channelName := params[0]
+	channelKey := context.casefold(params[0])
 	member := channelMember{'+'}
 
-	channel, present := context.channels[channelName]
+	channel, present := context.channels[channelKey]
 	if !present {
 		members := make(map[string]channelMember)
-		context.channels[channelName] = channelInfo{members}
+		context.channels[channelKey] = channelInfo{params[0], members}
 	}
-	channel, _ = context.channels[channelName]
+	channel, _ = context.channels[channelKey]
+	channelName := channel.name
 
-	user, _ := context.users[nick]
-	message := fmt.Sprintf(":%v!%v@%v JOIN %v\r\n", nick, user.user, user.host, params[0])
+	key := context.casefold(nick)
+	user, _ := context.users[key]
+	message := fmt.Sprintf(":%v!%v@%v JOIN %v\r\n", nick, user.user, user.host, channelName)
 
-	channel.members[nick] = member
+	channel.members[key] = member
 	for k := range channel.members {
-		context.users[k].channel <- message
+		context.users[k].sendq.send(message)
 	}
 
-	channelMembers := getMemberList(&channel)
-	user.channel <- fmt.Sprintf(":%v 332 %v %v :Test\r\n", context.info.name, nick, channelName)
+	channelMembers := getMemberList(context, &channel)
+	user.sendq.send(fmt.Sprintf(":%v 332 %v %v :Test\r\n", context.info.name, nick, channelName))
 	for _, r := range rplNames(context.info.name, nick, "=", channelName, channelMembers) {
-		user.channel <- r
+		user.sendq.send(r)
 	}
 
 	return Response{OK, ""}
 }
 
 func userPart(context *serverContext, nick string, params []string) Response {
-	channelName := params[0]
-
-	user, _ := context.users[nick]
-	channel, present := context.channels[channelName]
+	key := context.casefold(nick)
+	user, _ := context.users[key]
+	channel, present := context.channels[context.casefold(params[0])]
 	if !present {
 		return Response{ERR_NOSUCHCHANNEL, ""}
 	}
 
-	_, present = channel.members[nick]
+	_, present = channel.members[key]
 	if !present {
 		return Response{ERR_NOTONCHANNEL, ""}
 	}
 
 	var message string
 	if len(params) == 1 {
-		message = fmt.Sprintf(":%v!%v@%v PART %v\r\n", nick, user.user, user.host, params[0])
+		message = fmt.Sprintf(":%v!%v@%v PART %v\r\n", nick, user.user, user.host, channel.name)
 	} else {
-		message = fmt.Sprintf(":%v!%v@%v PART %v :%v\r\n", nick, user.user, user.host, params[0], params[1])
+		message = fmt.Sprintf(":%v!%v@%v PART %v :%v\r\n", nick, user.user, user.host, channel.name, params[1])
 	}
 	for k := range channel.members {
-		context.users[k].channel <- message
+		context.users[k].sendq.send(message)
 	}
 
-	delete(channel.members, nick)
+	delete(channel.members, key)
 	// FIXME: If no users left, delete channel
 
 	return Response{}
 }
 
 func getNames(context *serverContext, nick string, params []string) Response {
-	responseChan := context.users[nick].channel
+	sendq := context.users[context.casefold(nick)].sendq
 
 	if len(params) > 0 {
 		channelName := params[0]
-		channel, present := context.channels[channelName]
+		channel, present := context.channels[context.casefold(channelName)]
 		if !present {
-			responseChan <- fmt.Sprintf(":%v 366 %v %v :End of /NAMES list\r\n", context.info.name, nick, channelName)
+			sendq.send(fmt.Sprintf(":%v 366 %v %v :End of /NAMES list\r\n", context.info.name, nick, channelName))
 			return Response{ERR_NOSUCHCHANNEL, ""}
 		}
 
-		channelMembers := getMemberList(&channel)
-		for _, r := range rplNames(context.info.name, nick, "=", channelName, channelMembers) {
-			responseChan <- r
+		channelMembers := getMemberList(context, &channel)
+		for _, r := range rplNames(context.info.name, nick, "=", channel.name, channelMembers) {
+			sendq.send(r)
 		}
 	} else {
-		type cI struct {
-			name    string
-			channel channelInfo
+		for _, c := range sortedChannels(context) {
+			channelMembers := strings.TrimSpace(getMemberList(context, &c))
+			sendq.send(fmt.Sprintf(":%v 353 %v %v %v :%v\r\n", context.info.name, nick, "=", c.name, channelMembers))
 		}
-		channelList := []cI{}
-		for channelName, channel := range context.channels {
-			channelList = append(channelList, cI{channelName, channel})
+
+		sendq.send(fmt.Sprintf(":%v 366 %v :End of /NAMES list\r\n", context.info.name, nick))
+	}
+
+	return Response{OK, ""}
+}
+
+func getOnlineNicks(context *serverContext, nick string, params []string) Response {
+	online := []string{}
+	for _, n := range params {
+		user, present := context.users[context.casefold(n)]
+		if present && user.isRegistered() {
+			online = append(online, user.nick)
 		}
+	}
 
-		sort.Slice(channelList, func(i, j int) bool {
-			return channelList[i].name < channelList[j].name
-		})
+	return Response{OK, strings.Join(online, " ")}
+}
+
+func getUserHosts(context *serverContext, nick string, params []string) Response {
+	replies := []string{}
+	for _, n := range params {
+		user, present := context.users[context.casefold(n)]
+		if !present || !user.isRegistered() {
+			continue
+		}
 
-		for _, c := range channelList {
-			channelMembers := strings.TrimSpace(getMemberList(&c.channel))
-			responseChan <- fmt.Sprintf(":%v 353 %v %v %v :%v\r\n", context.info.name, nick, "=", c.name, channelMembers)
+		operator := ""
+		if user.modes['o'] {
+			operator = "*"
 		}
+		away := "+"
+		if len(user.away) > 0 {
+			away = "-"
+		}
+		replies = append(replies, fmt.Sprintf("%v%v=%v%v@%v", user.nick, operator, away, user.user, user.host))
+	}
+
+	return Response{OK, strings.Join(replies, " ")}
+}
 
-		responseChan <- fmt.Sprintf(":%v 366 %v :End of /NAMES list\r\n", context.info.name, nick)
+func getIsupport(context *serverContext, nick string, params []string) Response {
+	tokens := []string{
+		fmt.Sprintf("CASEMAPPING=%v", context.config.Casemapping),
+		fmt.Sprintf("MONITOR=%v", context.config.MonitorLimit),
+		fmt.Sprintf("NICKLEN=%v", context.config.NickLength),
+	}
+	if len(context.config.Network) > 0 {
+		tokens = slices.Insert(tokens, 2, fmt.Sprintf("NETWORK=%v", context.config.Network))
+	}
+
+	return Response{OK, strings.Join(tokens, " ")}
+}
+
+// params[0] is the subcommand, params[1] a comma separated list of targets
+func monitor(context *serverContext, nick string, params []string) Response {
+	key := context.casefold(nick)
+	user := context.users[key]
+	name := context.info.name
+
+	switch params[0] {
+	case "+":
+		if user.monitoring == nil {
+			user.monitoring = make(map[string]string)
+			context.users[key] = user
+		}
+
+		online := []string{}
+		offline := []string{}
+		targets := strings.Split(params[1], ",")
+		for i, target := range targets {
+			targetKey := context.casefold(target)
+			if _, present := user.monitoring[targetKey]; len(target) == 0 || present {
+				continue
+			}
+			if len(user.monitoring) >= context.config.MonitorLimit {
+				user.sendq.send(fmt.Sprintf(":%v 734 %v %v %v :Monitor list is full\r\n", name, nick, context.config.MonitorLimit, strings.Join(targets[i:], ",")))
+				break
+			}
+
+			user.monitoring[targetKey] = target
+			targetInfo, present := context.users[targetKey]
+			if present && targetInfo.isRegistered() {
+				online = append(online, userPrefix(targetInfo))
+			} else {
+				offline = append(offline, target)
+			}
+		}
+
+		sendMonitorStatus(user.sendq, name, nick, online, offline)
+	case "-":
+		for _, target := range strings.Split(params[1], ",") {
+			delete(user.monitoring, context.casefold(target))
+		}
+	case "C":
+		clear(user.monitoring)
+	case "L":
+		for _, r := range splitList(sortedValues(user.monitoring), 400) {
+			user.sendq.send(fmt.Sprintf(":%v 732 %v :%v\r\n", name, nick, r))
+		}
+		user.sendq.send(fmt.Sprintf(":%v 733 %v :End of MONITOR list\r\n", name, nick))
+	case "S":
+		online := []string{}
+		offline := []string{}
+		for _, target := range sortedValues(user.monitoring) {
+			targetInfo, present := context.users[context.casefold(target)]
+			if present && targetInfo.isRegistered() {
+				online = append(online, userPrefix(targetInfo))
+			} else {
+				offline = append(offline, target)
+			}
+		}
+
+		sendMonitorStatus(user.sendq, name, nick, online, offline)
 	}
 
 	return Response{OK, ""}
 }
 
+// params are the names of the enabled capabilities
+func setCapabilities(context *serverContext, nick string, params []string) Response {
+	key := context.casefold(nick)
+	user := context.users[key]
+	user.capabilities = make(map[string]bool)
+	for _, c := range params {
+		user.capabilities[c] = true
+	}
+	context.users[key] = user
+
+	return Response{OK, ""}
+}
+
+// Peers are only told if they have enabled the setname capability
+func setRealName(context *serverContext, nick string, params []string) Response {
+	key := context.casefold(nick)
+	user := context.users[key]
+	user.realName = params[0]
+	context.users[key] = user
+
+	message := fmt.Sprintf(":%v SETNAME :%v\r\n", userPrefix(user), user.realName)
+	for k := range channelPeers(context, key) {
+		peer := context.users[k]
+		if peer.capabilities["setname"] {
+			peer.sendq.send(message)
+		}
+	}
+
+	return Response{OK, ""}
+}
+
+// Sets the user and host shown in the users prefix, for example after cloaking.
+// params[0] is the new user, params[1] the new host.
+// Peers without the chghost capability see the user quit and rejoin their channels.
+func changeHost(context *serverContext, nick string, params []string) Response {
+	key := context.casefold(nick)
+	user, present := context.users[key]
+	if !present {
+		return Response{ERR_NOSUCHNICKNAME, ""}
+	}
+
+	oldPrefix := userPrefix(user)
+	user.user = params[0]
+	user.host = params[1]
+	context.users[key] = user
+
+	chghost := fmt.Sprintf(":%v CHGHOST %v %v\r\n", oldPrefix, user.user, user.host)
+	quit := fmt.Sprintf(":%v QUIT :Changing host\r\n", oldPrefix)
+	for k := range channelPeers(context, key) {
+		peer := context.users[k]
+		if peer.capabilities["chghost"] {
+			peer.sendq.send(chghost)
+			continue
+		}
+		if k == key {
+			continue
+		}
+
+		peer.sendq.send(quit)
+		for _, channel := range sortedChannels(context) {
+			_, userPresent := channel.members[key]
+			_, peerPresent := channel.members[k]
+			if userPresent && peerPresent {
+				peer.sendq.send(fmt.Sprintf(":%v JOIN %v\r\n", userPrefix(user), channel.name))
+			}
+		}
+	}
+
+	return Response{OK, ""}
+}
+
+// params[0] is the operator name.
+// Responds with its password hash if the user may use it, for the connection to check, since hashing is slow.
+func getOperPassword(context *serverContext, nick string, params []string) Response {
+	user := context.users[context.casefold(nick)]
+
+	// Don't reveal whether the name exists
+	oper, present := findOper(context, params[0])
+	if !present || !mayUseOper(context, oper, user) {
+		sendServerNotice(context, 'o', fmt.Sprintf("Failed OPER attempt by %v (%v@%v)", user.nick, user.user, user.realHost))
+		return Response{ERR_NOOPERHOST, ""}
+	}
+
+	return Response{OK, oper.Password}
+}
+
+// params[0] is the operator name, params[1] the hash from getOperPassword the password matched, empty if it didn't
+func operUp(context *serverContext, nick string, params []string) Response {
+	key := context.casefold(nick)
+	user := context.users[key]
+
+	// The config may have been reloaded since the password was checked
+	oper, present := findOper(context, params[0])
+	if !present || len(params[1]) == 0 || oper.Password != params[1] {
+		sendServerNotice(context, 'o', fmt.Sprintf("Failed OPER attempt by %v (%v@%v)", user.nick, user.user, user.realHost))
+		return Response{ERR_PASSWDMISMATCH, ""}
+	}
+
+	user.modes['o'] = true
+	user.privileges = classPrivileges(context, oper)
+	user.oper = oper
+	context.users[key] = user
+
+	return Response{OK, ""}
+}
+
+// params[0] is the privilege the user needs
+func hasPrivilege(context *serverContext, nick string, params []string) Response {
+	user := context.users[context.casefold(nick)]
+	if !user.modes['o'] || !slices.Contains(user.privileges, params[0]) {
+		return Response{ERR_NOPRIVILEGES, ""}
+	}
+
+	return Response{OK, ""}
+}
+
+func getUserModes(context *serverContext, nick string, params []string) Response {
+	user := context.users[context.casefold(nick)]
+
+	modes := "+"
+	for _, m := range []byte(supportedUserModes) {
+		if user.modes[m] {
+			modes += string(m)
+		}
+	}
+
+	return Response{OK, modes}
+}
+
+// params[0] is a mode string such as "+w-i", params[1] the optional snomask for +s such as "+ck-n".
+// Responds with the modes which actually changed, followed by the snomask after a space if +s was given.
+func setUserModes(context *serverContext, nick string, params []string) Response {
+	user := context.users[context.casefold(nick)]
+
+	result := OK
+	added := ""
+	removed := ""
+	adding := true
+	snomaskChanged := false
+	for _, m := range []byte(params[0]) {
+		switch {
+		case m == '+' || m == '-':
+			adding = m == '+'
+		case !strings.ContainsRune(supportedUserModes, rune(m)):
+			result = ERR_UMODEUNKNOWNFLAG
+		case m == 'o' && adding:
+			// Only OPER can grant operator status
+		case m == 'Z':
+			// Set by the connection, not the user
+		case m == 'x' && adding && len(context.config.CloakKey) == 0:
+			// Cloaking is turned off
+		case m == 's' && adding && !user.modes['o']:
+			// Server notices are only for operators
+		case m == 's' && adding:
+			if !user.modes[m] {
+				user.modes[m] = true
+				added += string(m)
+			}
+			snomask := "+" + supportedSnomasks
+			if len(params) > 1 {
+				snomask = params[1]
+			}
+			updateSnomasks(user.snomasks, snomask)
+			snomaskChanged = true
+		case adding && !user.modes[m]:
+			user.modes[m] = true
+			added += string(m)
+		case !adding && user.modes[m]:
+			delete(user.modes, m)
+			removed += string(m)
+		}
+	}
+	if !user.modes['o'] {
+		user.privileges = nil
+		user.oper = OperConfig{}
+		if user.modes['s'] {
+			delete(user.modes, 's')
+			removed += "s"
+		}
+	}
+	if !user.modes['s'] {
+		clear(user.snomasks)
+	}
+	context.users[context.casefold(nick)] = user
+
+	if strings.Contains(added, "x") {
+		changeHost(context, nick, []string{user.user, cloakHost(context.config.CloakKey, user.realHost)})
+	} else if strings.Contains(removed, "x") {
+		changeHost(context, nick, []string{user.user, user.realHost})
+	}
+
+	changes := ""
+	if len(added) > 0 {
+		changes += "+" + added
+	}
+	if len(removed) > 0 {
+		changes += "-" + removed
+	}
+	if snomaskChanged {
+		changes += " " + formatSnomasks(user.snomasks)
+	}
+
+	return Response{result, changes}
+}
+
+// params[0] is the nick of the user to disconnect, params[1] the reason
+func killUser(context *serverContext, nick string, params []string) Response {
+	key := context.casefold(params[0])
+	target, present := context.users[key]
+	if !present || !target.isRegistered() {
+		return Response{ERR_NOSUCHNICKNAME, ""}
+	}
+
+	killer := context.users[context.casefold(nick)]
+	message := fmt.Sprintf("Killed (%v (%v))", killer.nick, params[1])
+	sendServerNotice(context, 'k', fmt.Sprintf("Received KILL message for %v. From %v (%v)", target.nick, killer.nick, params[1]))
+
+	target.sendq.send(fmt.Sprintf(":%v KILL %v :%v\r\n", userPrefix(killer), target.nick, params[1]))
+	disconnectUser(context, key, message)
+
+	return Response{OK, ""}
+}
+
+// params[0] is the message
+func wallops(context *serverContext, nick string, params []string) Response {
+	sender := context.users[context.casefold(nick)]
+	message := fmt.Sprintf(":%v WALLOPS :%v\r\n", userPrefix(sender), params[0])
+
+	for _, user := range context.users {
+		if user.modes['w'] {
+			user.sendq.send(message)
+		}
+	}
+
+	return Response{OK, ""}
+}
+
+// params[0] is the message
+func globops(context *serverContext, nick string, params []string) Response {
+	for _, user := range context.users {
+		if user.modes['o'] {
+			user.sendq.send(fmt.Sprintf(":%v NOTICE %v :*** Global -- from %v: %v\r\n", context.info.name, user.nick, nick, params[0]))
+		}
+	}
+
+	return Response{OK, ""}
+}
+
+// params[0] is the stats letter.
+// Responds with the reply lines, not including RPL_ENDOFSTATS.
+func getStats(context *serverContext, nick string, params []string) Response {
+	replies := []string{}
+	var reply = func(format string, a ...any) {
+		replies = append(replies, fmt.Sprintf(":%v %v\r\n", context.info.name, fmt.Sprintf(format, a...)))
+	}
+
+	switch params[0] {
+	case "u":
+		uptime := time.Since(context.started)
+		seconds := int(uptime.Seconds())
+		reply("242 %v :Server Up %v days %v:%02d:%02d", nick, seconds/86400, seconds/3600%24, seconds/60%60, seconds%60)
+	case "m":
+		for _, c := range context.info.usage.counts() {
+			reply("212 %v %v %v %v 0", nick, c.command, c.count, c.bytes)
+		}
+	case "l":
+		ids := []int{}
+		for id := range context.clients {
+			i, _ := strconv.Atoi(id)
+			ids = append(ids, i)
+		}
+		slices.Sort(ids)
+
+		for _, i := range ids {
+			id := strconv.Itoa(i)
+			client := context.clients[id]
+			name := fmt.Sprintf("*[%v]", client.host)
+			for _, user := range context.users {
+				if user.id == id && user.isRegistered() {
+					name = fmt.Sprintf("%v[%v@%v]", user.nick, user.user, user.realHost)
+				}
+			}
+			// Traffic is in bytes rather than kilobytes
+			reply("211 %v %v %v %v %v %v %v %v", nick, name, client.sendq.length(),
+				client.stats.messagesOut.Load(), client.stats.bytesOut.Load(),
+				client.stats.messagesIn.Load(), client.stats.bytesIn.Load(),
+				int(time.Since(client.opened).Seconds()))
+		}
+	case "o":
+		for _, oper := range context.config.Opers {
+			for _, host := range oper.Hosts {
+				reply("243 %v O %v * %v 0 %v", nick, host, oper.Name, oper.Class)
+			}
+		}
+	case "k":
+		now := time.Now()
+		for _, b := range context.bans.Klines {
+			user, host, _ := strings.Cut(b.Mask, "@")
+			reply("216 %v K %v * %v 0 :%v", nick, host, user, b.describe(now))
+		}
+		for _, b := range context.bans.Dlines {
+			reply("225 %v D %v :%v", nick, b.Mask, b.describe(now))
+		}
+	case "c", "y":
+		// The default class is used even if it isn't configured
+		names := []string{defaultClass}
+		for _, class := range context.config.Classes {
+			if class.Name != defaultClass {
+				names = append(names, class.Name)
+			}
+		}
+		// There is no linking, so connect frequency and max links are always 0
+		for _, name := range names {
+			class := findClass(context.config, name)
+			reply("218 %v Y %v %v 0 0 %v", nick, class.Name, int(class.PingFrequency.Seconds()), class.SendQ)
+		}
+	}
+
+	return Response{OK, strings.Join(replies, "")}
+}
+
+// Responds with the location, organisation and email on separate lines,
+// or ERR_NOADMININFO if none are configured.
+func getAdmin(context *serverContext, nick string, params []string) Response {
+	admin := context.config.Admin
+	if admin == (AdminConfig{}) {
+		return Response{ERR_NOADMININFO, ""}
+	}
+
+	return Response{OK, strings.Join([]string{admin.Location, admin.Organisation, admin.Email}, "\n")}
+}
+
+// Responds with the lines of the MOTD separated by "\n", or ERR_NOMOTD if there isn't one
+func getMotd(context *serverContext, nick string, params []string) Response {
+	if len(context.motd) == 0 {
+		return Response{ERR_NOMOTD, ""}
+	}
+
+	return Response{OK, strings.Join(context.motd, "\n")}
+}
+
+// params[0] is the user, params[1] the host and params[2] the IP of a connection which is registering.
+// Responds with the reason if it is banned.
+func checkKline(context *serverContext, nick string, params []string) Response {
+	pruneBans(context)
+
+	b, banned := context.bans.findKline(klineUserHosts(context, params[0], params[1], params[1], params[2]), context.casefold)
+	if banned {
+		return Response{ERR_YOUREBANNEDCREEP, b.Reason}
+	}
+
+	return Response{OK, ""}
+}
+
+// params[0] is the IP of a new connection.
+// Responds with the reason if it is banned.
+func checkDline(context *serverContext, nick string, params []string) Response {
+	pruneBans(context)
+
+	b, banned := context.bans.findDline(params[0])
+	if banned {
+		return Response{ERR_YOUREBANNEDCREEP, b.Reason}
+	}
+
+	return Response{OK, ""}
+}
+
+// params[0] is a user@host mask or a nick, params[1] the duration in minutes (0 never expires) and params[2] the reason.
+// Responds with the mask, and disconnects anyone who matches it.
+func addKline(context *serverContext, nick string, params []string) Response {
+	mask := params[0]
+	if !strings.Contains(mask, "@") {
+		user, present := context.users[context.casefold(mask)]
+		if !present || !user.isRegistered() {
+			return Response{ERR_NOSUCHNICKNAME, ""}
+		}
+		mask = "*@" + user.realHost
+	}
+
+	b := newBan(nick, mask, params[1], params[2])
+	context.bans.Klines = slices.DeleteFunc(context.bans.Klines, func(old ban) bool {
+		return context.casefold(old.Mask) == context.casefold(mask)
+	})
+	context.bans.Klines = append(context.bans.Klines, b)
+	storeBans(context)
+
+	applyKline(context, b)
+
+	return Response{OK, mask}
+}
+
+// params[0] is an IP or CIDR, params[1] the duration in minutes (0 never expires) and params[2] the reason.
+// Disconnects anyone who matches it.
+func addDline(context *serverContext, nick string, params []string) Response {
+	b := newBan(nick, params[0], params[1], params[2])
+	context.bans.Dlines = slices.DeleteFunc(context.bans.Dlines, func(old ban) bool { return old.Mask == b.Mask })
+	context.bans.Dlines = append(context.bans.Dlines, b)
+	storeBans(context)
+
+	applyDline(context, b)
+
+	return Response{OK, b.Mask}
+}
+
+// params[0] is the mask
+func removeKline(context *serverContext, nick string, params []string) Response {
+	before := len(context.bans.Klines)
+	context.bans.Klines = slices.DeleteFunc(context.bans.Klines, func(b ban) bool {
+		return context.casefold(b.Mask) == context.casefold(params[0])
+	})
+	if len(context.bans.Klines) == before {
+		return Response{ERR_NOSUCHBAN, ""}
+	}
+
+	storeBans(context)
+	return Response{OK, ""}
+}
+
+// params[0] is the IP or CIDR
+func removeDline(context *serverContext, nick string, params []string) Response {
+	before := len(context.bans.Dlines)
+	context.bans.Dlines = slices.DeleteFunc(context.bans.Dlines, func(b ban) bool { return b.Mask == params[0] })
+	if len(context.bans.Dlines) == before {
+		return Response{ERR_NOSUCHBAN, ""}
+	}
+
+	storeBans(context)
+	return Response{OK, ""}
+}
+
+// params[0] is the IP of the gateway.
+// Responds with the password hashes of the gateways it may be, one per line.
+// Hashing is slow, so the connection checks the password itself rather than holding up the server.
+func getWebircPasswords(context *serverContext, nick string, params []string) Response {
+	addr, err := netip.ParseAddr(params[0])
+	if err != nil {
+		return Response{ERR_PASSWDMISMATCH, ""}
+	}
+
+	passwords := []string{}
+	for _, webirc := range context.config.Webirc {
+		if slices.ContainsFunc(webirc.Hosts, func(mask string) bool { return matchIP(mask, addr) }) {
+			passwords = append(passwords, webirc.Password)
+		}
+	}
+	if len(passwords) == 0 {
+		return Response{ERR_PASSWDMISMATCH, ""}
+	}
+	return Response{OK, strings.Join(passwords, "\n")}
+}
+
+// params[0] is the account name.
+// Responds with its password hash for SASL PLAIN, or ERR_SASLFAIL if it has none.
+func getAccountPassword(context *serverContext, nick string, params []string) Response {
+	for _, account := range context.config.Accounts {
+		if account.Name == params[0] && len(account.Password) > 0 {
+			return Response{OK, account.Password}
+		}
+	}
+	return Response{ERR_SASLFAIL, ""}
+}
+
+// Checks SASL EXTERNAL. params[0] is the account name, which may be empty, and params[1] the certificate fingerprint.
+// Responds with the name of the account, or ERR_SASLFAIL.
+func checkAccount(context *serverContext, nick string, params []string) Response {
+	for _, account := range context.config.Accounts {
+		if len(params[0]) > 0 && account.Name != params[0] {
+			continue
+		}
+		if len(account.Certfp) > 0 && account.Certfp == params[1] {
+			return Response{OK, account.Name}
+		}
+	}
+	return Response{ERR_SASLFAIL, ""}
+}
+
+// params[0] is the nick to look up.
+// Responds with the account they are logged in to, empty if they aren't.
+func getAccount(context *serverContext, nick string, params []string) Response {
+	user, present := context.users[context.casefold(params[0])]
+	if !present {
+		return Response{ERR_NOSUCHNICKNAME, ""}
+	}
+	return Response{OK, user.account}
+}
+
+// Tells operators about a connection closed for flooding, params[0] is its host
+func excessFlood(context *serverContext, nick string, params []string) Response {
+	user, present := context.users[context.casefold(nick)]
+	if !present || !user.isRegistered() {
+		sendServerNotice(context, 'f', fmt.Sprintf("Excess Flood from unregistered connection (%v)", params[0]))
+		return Response{OK, ""}
+	}
+
+	sendServerNotice(context, 'f', fmt.Sprintf("Excess Flood from %v (%v@%v)", user.nick, user.user, user.realHost))
+	return Response{OK, ""}
+}
+
+// Swaps in a new config without disconnecting anyone.
+// Operators already online get the privileges of their new oper block, see refreshOpers.
+func applyConfig(context *serverContext, config Config) ([]string, error) {
+	old := context.config
+	if config.Name != old.Name {
+		return nil, errors.New("name can't be changed without a restart")
+	}
+	if config.Casemapping != old.Casemapping {
+		return nil, errors.New("casemapping can't be changed without a restart")
+	}
+
+	bans := context.bans
+	if config.BanFile != old.BanFile {
+		var err error
+		bans, err = loadBans(config.BanFile)
+		if err != nil {
+			return nil, fmt.Errorf("ban_file: %w", err)
+		}
+	}
+
+	// Read again even if the file name is the same, as the contents may have changed
+	motd, err := loadMotd(config.MotdFile)
+	if err != nil {
+		return nil, fmt.Errorf("motd_file: %w", err)
+	}
+
+	changes := []string{}
+	var changed = func(setting string, from any, to any) {
+		if from != to {
+			changes = append(changes, fmt.Sprintf("%v changed from %q to %q", setting, fmt.Sprint(from), fmt.Sprint(to)))
+		}
+	}
+	changed("network", old.Network, config.Network)
+	changed("motd_file", old.MotdFile, config.MotdFile)
+	changed("admin", old.Admin, config.Admin)
+	changed("monitor_limit", old.MonitorLimit, config.MonitorLimit)
+	changed("nick_length", old.NickLength, config.NickLength)
+	changed("ban_file", old.BanFile, config.BanFile)
+	changed("limits.max_clients", old.Limits.MaxClients, config.Limits.MaxClients)
+	changed("limits.max_per_ip", old.Limits.MaxPerIP, config.Limits.MaxPerIP)
+	changed("limits.throttle_count", old.Limits.ThrottleCount, config.Limits.ThrottleCount)
+	changed("limits.throttle_window", old.Limits.ThrottleWindow, config.Limits.ThrottleWindow)
+	changed("limits.ipv4_cidr", old.Limits.IPv4Cidr, config.Limits.IPv4Cidr)
+	changed("limits.ipv6_cidr", old.Limits.IPv6Cidr, config.Limits.IPv6Cidr)
+	changed("limits.exempt", strings.Join(old.Limits.Exempt, " "), strings.Join(config.Limits.Exempt, " "))
+	if config.CloakKey != old.CloakKey {
+		// Don't reveal the key
+		changes = append(changes, "cloak_key changed, users get the new cloak when they next connect or set +x")
+	}
+	if !slices.EqualFunc(old.Listeners, config.Listeners, func(a ListenerConfig, b ListenerConfig) bool {
+		return a.Address == b.Address && a.Certificate == b.Certificate && a.Key == b.Key &&
+			a.Proxy == b.Proxy && slices.Equal(a.ProxyFrom, b.ProxyFrom) && a.Class == b.Class
+	}) {
+		changes = append(changes, "listeners will change after a restart")
+	}
+	changes = append(changes, describeBlockChanges("class", old.Classes, config.Classes,
+		func(c ClassConfig) string { return c.Name },
+		func(a ClassConfig, b ClassConfig) bool { return a == b })...)
+	changes = append(changes, describeBlockChanges("oper", old.Opers, config.Opers,
+		func(o OperConfig) string { return o.Name },
+		func(a OperConfig, b OperConfig) bool {
+			return a.Password == b.Password && a.Class == b.Class && slices.Equal(a.Hosts, b.Hosts)
+		})...)
+	changes = append(changes, describeBlockChanges("oper class", old.OperClasses, config.OperClasses,
+		func(c OperClassConfig) string { return c.Name },
+		func(a OperClassConfig, b OperClassConfig) bool { return slices.Equal(a.Privileges, b.Privileges) })...)
+	changes = append(changes, describeBlockChanges("webirc", old.Webirc, config.Webirc,
+		func(w WebircConfig) string { return w.Name },
+		func(a WebircConfig, b WebircConfig) bool {
+			return a.Password == b.Password && slices.Equal(a.Hosts, b.Hosts)
+		})...)
+	changes = append(changes, describeBlockChanges("account", old.Accounts, config.Accounts,
+		func(a AccountConfig) string { return a.Name },
+		func(a AccountConfig, b AccountConfig) bool { return a == b })...)
+
+	isupport := getIsupport(context, "", []string{}).params
+	context.config = config
+	context.bans = bans
+	context.motd = motd
+	refreshOpers(context)
+	if config.Limits.IPv4Cidr != old.Limits.IPv4Cidr || config.Limits.IPv6Cidr != old.Limits.IPv6Cidr {
+		recountConnections(context)
+	}
+	if config.BanFile != old.BanFile {
+		for _, b := range context.bans.Klines {
+			applyKline(context, b)
+		}
+		for _, b := range context.bans.Dlines {
+			applyDline(context, b)
+		}
+	}
+
+	// Let clients know about changed limits
+	newIsupport := getIsupport(context, "", []string{}).params
+	if newIsupport != isupport {
+		for _, user := range context.users {
+			if user.isRegistered() {
+				user.sendq.send(rplIsupport(context.info.name, user.nick, newIsupport))
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+// Gives operators the privileges of their oper block in the current config.
+// Operators whose block was removed, has a new password or no longer matches their host stop being operators.
+func refreshOpers(context *serverContext) {
+	for key, user := range context.users {
+		if !user.modes['o'] {
+			continue
+		}
+
+		oper, present := findOper(context, user.oper.Name)
+		if present && oper.Password == user.oper.Password && mayUseOper(context, oper, user) {
+			user.privileges = classPrivileges(context, oper)
+			user.oper = oper
+			context.users[key] = user
+			continue
+		}
+
+		changes := setUserModes(context, user.nick, []string{"-o"}).params
+		user.sendq.send(fmt.Sprintf(":%v MODE %v :%v\r\n", user.nick, user.nick, changes))
+	}
+}
+
 // utility funcs
-func getMemberList(c *channelInfo) string {
+// Describes which of a list of named config blocks were added, removed or changed
+func describeBlockChanges[T any](kind string, old []T, new []T, name func(T) string, equal func(T, T) bool) []string {
+	changes := []string{}
+	for _, o := range old {
+		i := slices.IndexFunc(new, func(n T) bool { return name(n) == name(o) })
+		if i < 0 {
+			changes = append(changes, fmt.Sprintf("%v %q removed", kind, name(o)))
+		} else if !equal(o, new[i]) {
+			changes = append(changes, fmt.Sprintf("%v %q changed", kind, name(o)))
+		}
+	}
+	for _, n := range new {
+		if !slices.ContainsFunc(old, func(o T) bool { return name(n) == name(o) }) {
+			changes = append(changes, fmt.Sprintf("%v %q added", kind, name(n)))
+		}
+	}
+
+	return changes
+}
+
+// Sends the user an ERROR, tells everyone who shares a channel with them that they have quit and closes the connection
+func disconnectUser(context *serverContext, key string, message string) {
+	user := context.users[key]
+
+	user.sendq.send(fmt.Sprintf(":%v ERROR :Closing Link: %v %v\r\n", context.info.name, user.realHost, message))
+	quitUser(context, key, message)
+	requestQuit(user.quit)
+}
+
+// Disconnects everyone who matches the K-line
+func applyKline(context *serverContext, b ban) {
+	for key, user := range context.users {
+		if user.isRegistered() && slices.ContainsFunc(klineUserHosts(context, user.user, user.realHost, user.host, user.ip), func(userHost string) bool {
+			return matchMask(b.Mask, userHost, context.casefold)
+		}) {
+			sendServerNotice(context, 'k', fmt.Sprintf("K-line active for %v (%v@%v)", user.nick, user.user, user.realHost))
+			disconnectUser(context, key, fmt.Sprintf("K-lined (%v)", b.Reason))
+		}
+	}
+}
+
+// The user@hosts K-lines are matched against.
+// Besides the real host, operators may only know the host others see, which is the cloak while cloaking is on,
+// or the IP, which the real host replaces once it has been looked up.
+func klineUserHosts(context *serverContext, user string, realHost string, host string, ip string) []string {
+	userHosts := []string{user + "@" + realHost, user + "@" + host, user + "@" + ip}
+	if len(context.config.CloakKey) > 0 {
+		userHosts = append(userHosts, user+"@"+cloakHost(context.config.CloakKey, realHost))
+	}
+	return userHosts
+}
+
+// Disconnects everyone who matches the D-line
+func applyDline(context *serverContext, b ban) {
+	for key, user := range context.users {
+		addr, err := netip.ParseAddr(user.ip)
+		if user.isRegistered() && err == nil && matchIP(b.Mask, addr) {
+			sendServerNotice(context, 'k', fmt.Sprintf("D-line active for %v (%v@%v)", user.nick, user.user, user.realHost))
+			disconnectUser(context, key, fmt.Sprintf("D-lined (%v)", b.Reason))
+		}
+	}
+}
+
+// Sends a connection an ERROR and closes it, whether or not it has registered.
+// The client is forgotten once the connection reports it has closed.
+func closeClient(context *serverContext, id string, message string) {
+	client := context.clients[id]
+	client.sendq.send(fmt.Sprintf(":%v ERROR :Closing Link: %v %v\r\n", context.info.name, client.host, message))
+	requestQuit(client.quit)
+}
+
+func (s Shutdown) message() string {
+	if s.restart {
+		return fmt.Sprintf("Server restarting (%v)", s.reason)
+	}
+	return fmt.Sprintf("Server shutting down (%v)", s.reason)
+}
+
+// minutes comes from the command parameters and has already been validated
+func newBan(setBy string, mask string, minutes string, reason string) ban {
+	now := time.Now()
+	b := ban{Mask: mask, Reason: reason, SetBy: setBy, SetAt: now}
+
+	duration, _ := strconv.Atoi(minutes)
+	if duration > 0 {
+		b.Expires = now.Add(time.Duration(duration) * time.Minute)
+	}
+
+	return b
+}
+
+func pruneBans(context *serverContext) {
+	if context.bans.prune(time.Now()) {
+		storeBans(context)
+	}
+}
+
+func storeBans(context *serverContext) {
+	err := saveBans(context.config.BanFile, context.bans)
+	if err != nil {
+		fmt.Printf("Could not save bans to %v: %v\n", context.config.BanFile, err)
+	}
+}
+
+func registeredUsers(context *serverContext) int {
+	count := 0
+	for _, user := range context.users {
+		if user.isRegistered() {
+			count += 1
+		}
+	}
+
+	return count
+}
+
+// Tells everyone who shares a channel with the user that they have quit, then removes them
+func quitUser(context *serverContext, key string, message string) {
+	user := context.users[key]
+	if user.isRegistered() {
+		quit := fmt.Sprintf(":%v QUIT :%v\r\n", userPrefix(user), message)
+		for k := range channelPeers(context, key) {
+			if k != key {
+				context.users[k].sendq.send(quit)
+			}
+		}
+	}
+
+	for _, channel := range context.channels {
+		delete(channel.members, key)
+	}
+	removeUser(context, user.nick)
+
+	if user.isRegistered() {
+		sendServerNotice(context, 'c', fmt.Sprintf("Client exiting: %v (%v@%v) [%v]", user.nick, user.user, user.realHost, message))
+	}
+}
+
+// Sends a notice to every operator subscribed to the category, one of supportedSnomasks
+func sendServerNotice(context *serverContext, snomask byte, message string) {
+	for _, user := range context.users {
+		if user.isRegistered() && user.modes['s'] && user.snomasks[snomask] {
+			user.sendq.send(fmt.Sprintf(":%v NOTICE %v :*** Notice -- %v\r\n", context.info.name, user.nick, message))
+		}
+	}
+}
+
+// Applies a change such as "+ck-n", letters without a sign are added
+func updateSnomasks(snomasks map[byte]bool, change string) {
+	adding := true
+	for _, s := range []byte(change) {
+		switch {
+		case s == '+' || s == '-':
+			adding = s == '+'
+		case !strings.ContainsRune(supportedSnomasks, rune(s)):
+		case adding:
+			snomasks[s] = true
+		default:
+			delete(snomasks, s)
+		}
+	}
+}
+
+// Such as "+ckn", in the order of supportedSnomasks
+func formatSnomasks(snomasks map[byte]bool) string {
+	formatted := "+"
+	for _, s := range []byte(supportedSnomasks) {
+		if snomasks[s] {
+			formatted += string(s)
+		}
+	}
+
+	return formatted
+}
+
+// Whether the user is connecting from one of the oper block's hosts
+func mayUseOper(context *serverContext, oper OperConfig, user userInfo) bool {
+	return slices.ContainsFunc(oper.Hosts, func(mask string) bool {
+		return matchMask(mask, user.user+"@"+user.realHost, context.casefold) || matchMask(mask, user.user+"@"+user.ip, context.casefold)
+	})
+}
+
+// The privileges of the oper block's class, none if the class doesn't exist
+func classPrivileges(context *serverContext, oper OperConfig) []string {
+	for _, class := range context.config.OperClasses {
+		if class.Name == oper.Class {
+			return class.Privileges
+		}
+	}
+
+	return []string{}
+}
+
+func findOper(context *serverContext, name string) (OperConfig, bool) {
+	for _, oper := range context.config.Opers {
+		if oper.Name == name {
+			return oper, true
+		}
+	}
+
+	return OperConfig{}, false
+}
+
+// The keys of every user who shares a channel with the user, including themselves.
+// Each user is only included once, however many channels they share.
+func channelPeers(context *serverContext, key string) map[string]bool {
+	peers := map[string]bool{key: true}
+	for _, channel := range context.channels {
+		if _, present := channel.members[key]; !present {
+			continue
+		}
+		for k := range channel.members {
+			peers[k] = true
+		}
+	}
+
+	return peers
+}
+
+func sortedChannels(context *serverContext) []channelInfo {
+	channelList := []channelInfo{}
+	for _, channel := range context.channels {
+		channelList = append(channelList, channel)
+	}
+
+	sort.Slice(channelList, func(i, j int) bool {
+		return channelList[i].name < channelList[j].name
+	})
+
+	return channelList
+}
+
+// Deletes the user and tells anyone monitoring them that they have gone
+func removeUser(context *serverContext, nick string) {
+	key := context.casefold(nick)
+	user, present := context.users[key]
+	delete(context.users, key)
+
+	if present && user.isRegistered() {
+		notifyMonitors(context, user.nick, func(watcher string) string {
+			return rplMonOffline(context.info.name, watcher, []string{user.nick})
+		})
+	}
+}
+
+// Sends a 730/731 reply to every user monitoring nick
+func notifyMonitors(context *serverContext, nick string, reply func(watcher string) string) {
+	key := context.casefold(nick)
+	for _, watcher := range context.users {
+		if _, present := watcher.monitoring[key]; present {
+			watcher.sendq.send(reply(watcher.nick))
+		}
+	}
+}
+
+func sendMonitorStatus(sendq *sendQueue, server string, nick string, online []string, offline []string) {
+	if len(online) > 0 {
+		sendq.send(rplMonOnline(server, nick, online))
+	}
+	if len(offline) > 0 {
+		sendq.send(rplMonOffline(server, nick, offline))
+	}
+}
+
+func rplMonOnline(server string, nick string, targets []string) string {
+	return fmt.Sprintf(":%v 730 %v :%v\r\n", server, nick, strings.Join(targets, ","))
+}
+
+func rplMonOffline(server string, nick string, targets []string) string {
+	return fmt.Sprintf(":%v 731 %v :%v\r\n", server, nick, strings.Join(targets, ","))
+}
+
+func userPrefix(user userInfo) string {
+	return fmt.Sprintf("%v!%v@%v", user.nick, user.user, user.host)
+}
+
+// Joins items with commas into lines no longer than maxLength
+func splitList(items []string, maxLength int) []string {
+	lines := []string{}
+	var line strings.Builder
+	for _, item := range items {
+		if line.Len() > 0 && line.Len()+len(item)+1 > maxLength {
+			lines = append(lines, line.String())
+			line.Reset()
+		}
+		if line.Len() > 0 {
+			line.WriteByte(',')
+		}
+		line.WriteString(item)
+	}
+	if line.Len() > 0 {
+		lines = append(lines, line.String())
+	}
+
+	return lines
+}
+
+func sortedValues(m map[string]string) []string {
+	values := []string{}
+	for _, v := range m {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+
+	return values
+}
+
+// Nicks are reserved by NICK before the connection has finished registering
+func (u userInfo) isRegistered() bool {
+	return u.sendq != nil
+}
+
+func getMemberList(context *serverContext, c *channelInfo) string {
 	type memberData struct {
 		name string
 		mode byte
@@ -335,7 +1838,7 @@ func getMemberList(c *channelInfo) string {
 	membersList := []memberData{}
 	for k, v := range c.members {
 		mode := v.mode
-		membersList = append(membersList, memberData{k, mode})
+		membersList = append(membersList, memberData{context.users[k].nick, mode})
 	}
 	sort.Slice(membersList, func(first, second int) bool {
 		return membersList[first].name < membersList[second].name
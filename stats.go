@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Traffic on a single connection, updated by its reader and writer
+type connectionStats struct {
+	bytesIn     atomic.Int64
+	bytesOut    atomic.Int64
+	messagesIn  atomic.Int64
+	messagesOut atomic.Int64
+}
+
+// How often each command has been used, for STATS m.
+// Updated by every connection, so it is safe to use concurrently.
+type commandUsage struct {
+	mutex    sync.Mutex
+	commands map[string]commandCount
+}
+
+type commandCount struct {
+	command string
+	count   int
+	bytes   int
+}
+
+func newCommandUsage() *commandUsage {
+	return &commandUsage{commands: make(map[string]commandCount)}
+}
+
+// bytes is the length of the whole message
+func (u *commandUsage) record(command string, bytes int) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	c := u.commands[command]
+	c.command = command
+	c.count += 1
+	c.bytes += bytes
+	u.commands[command] = c
+}
+
+// Sorted by command
+func (u *commandUsage) counts() []commandCount {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	counts := []commandCount{}
+	for _, c := range u.commands {
+		counts = append(counts, c)
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].command < counts[j].command })
+
+	return counts
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// The certificate and key files of a TLS listener
+type certificateFiles struct {
+	certificate string
+	key         string
+}
+
+// Certificates used by TLS listeners, which can be reloaded without closing the listeners.
+// Shared by the listeners and REHASH, so it is safe to use concurrently.
+type certificateStore struct {
+	mutex        sync.RWMutex
+	certificates map[certificateFiles]*tls.Certificate
+}
+
+func newCertificateStore() *certificateStore {
+	return &certificateStore{certificates: make(map[certificateFiles]*tls.Certificate)}
+}
+
+// Loads the certificate if needed, then returns a config which always uses the latest copy of it.
+// Client certificates are requested but not verified, so their fingerprints can be used to identify users.
+func (s *certificateStore) tlsConfig(files certificateFiles) (*tls.Config, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, present := s.certificates[files]; !present {
+		certificate, err := tls.LoadX509KeyPair(files.certificate, files.key)
+		if err != nil {
+			return nil, err
+		}
+		s.certificates[files] = &certificate
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequestClientCert,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			s.mutex.RLock()
+			defer s.mutex.RUnlock()
+			return s.certificates[files], nil
+		},
+	}, nil
+}
+
+// Reads every certificate from disk again. Certificates which fail to load keep their old copy.
+func (s *certificateStore) reload() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	problems := []error{}
+	for files := range s.certificates {
+		certificate, err := tls.LoadX509KeyPair(files.certificate, files.key)
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		s.certificates[files] = &certificate
+	}
+
+	return errors.Join(problems...)
+}
+
+// As returned by certificateFingerprint
+func isCertificateFingerprint(s string) bool {
+	decoded, err := hex.DecodeString(s)
+	return err == nil && len(decoded) == sha256.Size && s == strings.ToLower(s)
+}
+
+// The hex SHA-256 fingerprint of the client certificate, or an empty string if there isn't one
+func certificateFingerprint(state tls.ConnectionState) string {
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+	return hex.EncodeToString(sum[:])
+}